@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// atomicFile is written in place of the file at path, which it replaces only
+// once it's complete. It's a temporary file alongside until commit syncs it
+// and renames it into place, so that however the run ends (even in a crash),
+// the file at path is either the old one or the new one, never a partial one.
+type atomicFile struct {
+	*os.File
+	path string
+}
+
+func createAtomic(path string) (*atomicFile, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{File: tmp, path: path}, nil
+}
+
+// commit replaces the file at path with f, which is made readable by all, as the
+// other outputs are (os.CreateTemp's files aren't). If it fails, f is removed
+// and the file at path is left as it was.
+func (f *atomicFile) commit() error {
+	err := f.Sync()
+	if err == nil {
+		err = f.Chmod(0o644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	// The rename is only durable once the directory has been synced too.
+	dir, err := os.Open(filepath.Dir(f.path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// abort removes f, leaving the file at path as it was.
+func (f *atomicFile) abort() {
+	f.Close()
+	os.Remove(f.Name())
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	sizePage    = 4096 // The ranges are observed to the page.
+	sizeBuckets = 256  // Up to 1MiB; larger ranges share the last bucket.
+)
+
+// bufPool is a pool of range buffers whose capacity follows the distribution of
+// the ranges seen. New buffers are allocated with the capacity of the 99th
+// percentile of the ranges observed so far (or the initial hint, until a chunk's
+// worth have been), so that an outlier doesn't inflate every buffer: only the
+// buffer it lands in grows to fit it, and that buffer is dropped rather than
+// kept once it's returned.
+type bufPool struct {
+	pool sync.Pool
+	size atomic.Int64 // The capacity of new buffers.
+
+	seen  [sizeBuckets]atomic.Int64 // The ranges observed, by size in pages (rounded up).
+	count atomic.Int64
+}
+
+func newBufPool(hint int) *bufPool {
+	p := &bufPool{}
+	p.size.Store(int64(hint))
+	p.pool.New = func() any {
+		return bytes.NewBuffer(make([]byte, 0, p.size.Load()))
+	}
+	return p
+}
+
+func (p *bufPool) get() *bytes.Buffer {
+	return p.pool.Get().(*bytes.Buffer)
+}
+
+// put resets buf and returns it to the pool, unless it's oversized.
+func (p *bufPool) put(buf *bytes.Buffer) {
+	if p.oversized(buf) {
+		return
+	}
+	buf.Reset()
+	p.pool.Put(buf)
+}
+
+// oversized reports whether buf has grown well beyond the size of new buffers,
+// as it will have done to fit an outlier.
+func (p *bufPool) oversized(buf *bytes.Buffer) bool {
+	return int64(buf.Cap()) > 2*p.size.Load()
+}
+
+// observe records the size of a range. The size of new buffers is revised after
+// each chunk's worth of ranges.
+func (p *bufPool) observe(n int) {
+	p.seen[min((n+sizePage-1)/sizePage, sizeBuckets-1)].Add(1)
+	if p.count.Add(1)%0x1000 != 0 {
+		return
+	}
+
+	var total int64
+	var counts [sizeBuckets]int64
+	for i := range p.seen {
+		counts[i] = p.seen[i].Load()
+		total += counts[i]
+	}
+	var cum int64
+	for i, c := range counts {
+		if cum += c; cum*100 >= total*99 {
+			p.size.Store(int64(max(i, 1)) * sizePage)
+			return
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBufPoolFollowsTheDistribution(t *testing.T) {
+	p := newBufPool(48_000)
+	for i := 0; i < 0xfff; i++ {
+		p.observe(32_000)
+	}
+	p.observe(900_000) // An outlier.
+
+	if got, want := p.size.Load(), int64(32_768); got != want {
+		t.Fatalf("got buffers of %d bytes, want %d", got, want)
+	}
+	if buf := p.get(); buf.Cap() != 32_768 {
+		t.Errorf("got a new buffer of %d bytes, want %d", buf.Cap(), 32_768)
+	}
+
+	outlier := bytes.NewBuffer(make([]byte, 0, 900_000))
+	if !p.oversized(outlier) {
+		t.Error("the outlier's buffer isn't oversized")
+	}
+	if p.oversized(bytes.NewBuffer(make([]byte, 0, 40_000))) {
+		t.Error("a buffer a little over the size is oversized")
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// maxClockSkew is how far the local clock may be from the server's before it's
+// warned about. The Date header is only to the second, and the response takes
+// a while to arrive, so a few seconds are to be expected.
+const maxClockSkew = time.Minute
+
+// checkClock compares the Date header of the first response with the local time
+// at which it arrived, and warns if they differ by more than maxClockSkew. A
+// skewed clock upsets the Last-Modified times recorded under -etags (those in
+// the future are dropped) and so the If-Modified-Since requests made with them.
+func (d *hibp) checkClock(resp *http.Response, received time.Time) {
+	if d.clockChecked.Swap(true) {
+		return
+	}
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	skew := received.Sub(date)
+	if skew.Abs() > maxClockSkew {
+		slog.Warn("The local clock is skewed from the server's, which upsets conditional requests under -etags",
+			slog.Duration("skew", skew.Round(time.Second)), slog.Time("server", date), slog.Time("local", received))
+	}
+}
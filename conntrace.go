@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connStats counts, under -conntrace, whether the requests' connections were
+// reused or freshly dialed, and the DNS lookups and TLS handshakes made for the
+// fresh ones. Over https, it keeps what the last handshake negotiated.
+type connStats struct {
+	reused        atomic.Int64
+	fresh         atomic.Int64
+	dnsLookups    atomic.Int64
+	tlsHandshakes atomic.Int64
+
+	mu  sync.Mutex
+	tls *tlsReport
+
+	trace *httptrace.ClientTrace // Shared by every request.
+}
+
+// connReport is the part of the report given by connStats.
+type connReport struct {
+	Reused        int64 `json:"reused"`
+	Fresh         int64 `json:"fresh"`
+	DNSLookups    int64 `json:"dns_lookups"`
+	TLSHandshakes int64 `json:"tls_handshakes"`
+
+	TLS *tlsReport `json:"tls,omitempty"` // Only over https.
+}
+
+// certExpiryWarning is how close to expiring the server's certificate must be
+// for the report to warn about it.
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// tls returns what the last handshake negotiated, or nil if r is nil or there
+// was no handshake.
+func (r *connReport) tls() *tlsReport {
+	if r == nil {
+		return nil
+	}
+	return r.TLS
+}
+
+// tlsReport is what a TLS handshake negotiated, and when the server's
+// certificate expires.
+type tlsReport struct {
+	Version     string    `json:"version"`
+	CipherSuite string    `json:"cipher_suite"`
+	LeafExpiry  time.Time `json:"leaf_expiry"`
+}
+
+func newConnStats() *connStats {
+	c := &connStats{}
+	c.trace = &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				c.reused.Add(1)
+			} else {
+				c.fresh.Add(1)
+			}
+		},
+		DNSStart:          func(httptrace.DNSStartInfo) { c.dnsLookups.Add(1) },
+		TLSHandshakeStart: func() { c.tlsHandshakes.Add(1) },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil || len(state.PeerCertificates) == 0 {
+				return
+			}
+			r := &tlsReport{
+				Version:     tls.VersionName(state.Version),
+				CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+				LeafExpiry:  state.PeerCertificates[0].NotAfter,
+			}
+			c.mu.Lock()
+			c.tls = r
+			c.mu.Unlock()
+		},
+	}
+	return c
+}
+
+// withTrace returns ctx with the trace attached, or ctx itself if c is nil.
+func (c *connStats) withTrace(ctx context.Context) context.Context {
+	if c == nil {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, c.trace)
+}
+
+// report returns the counts, or nil if c is nil.
+func (c *connStats) report() *connReport {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &connReport{
+		Reused:        c.reused.Load(),
+		Fresh:         c.fresh.Load(),
+		DNSLookups:    c.dnsLookups.Load(),
+		TLSHandshakes: c.tlsHandshakes.Load(),
+		TLS:           c.tls,
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConnStatsTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	c := newConnStats()
+	req, err := http.NewRequestWithContext(c.withTrace(context.Background()), "GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	r := c.report()
+	if r.Fresh != 1 || r.TLSHandshakes != 1 || r.TLS == nil {
+		t.Fatalf("got %+v, want a fresh connection with a TLS handshake", r)
+	}
+	state := resp.TLS
+	want := tlsReport{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		LeafExpiry:  srv.Certificate().NotAfter,
+	}
+	if *r.TLS != want {
+		t.Fatalf("got %+v, want %+v", *r.TLS, want)
+	}
+}
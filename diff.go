@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// diffTars writes the differences between the ranges of the tars at oldPath
+// and newPath (either of which may be gzipped) to w, a line per hash:
+//
+//	+HASH:COUNT        added
+//	-HASH:COUNT        removed
+//	~HASH:OLD->NEW     the count changed
+//
+// The tars are walked together, a member at a time, so only a single range
+// from each is held in memory. It returns the number of lines written.
+func diffTars(oldPath, newPath string, w io.Writer) (int, error) {
+	older, err := openMembers(oldPath)
+	if err != nil {
+		return 0, err
+	}
+	defer older.close()
+	newer, err := openMembers(newPath)
+	if err != nil {
+		return 0, err
+	}
+	defer newer.close()
+
+	bw := bufio.NewWriter(w)
+	changes := 0
+	for older.name != "" || newer.name != "" {
+		// The members are written in ascending order, so those missing from one
+		// tar are found as in a merge.
+		var a, b map[string]string
+		name := older.name
+		switch {
+		case newer.name == "" || (older.name != "" && older.name < newer.name):
+			a, err = older.next()
+		case older.name == "" || newer.name < older.name:
+			name = newer.name
+			b, err = newer.next()
+		default:
+			if a, err = older.next(); err == nil {
+				b, err = newer.next()
+			}
+		}
+		if err != nil {
+			return changes, err
+		}
+		changes += diffRange(bw, strings.ToUpper(name), a, b)
+	}
+	return changes, bw.Flush()
+}
+
+// diffRange writes the differences between two ranges with the given prefix.
+func diffRange(w io.Writer, prefix string, older, newer map[string]string) int {
+	var lines []string
+	for suffix, count := range newer {
+		old, ok := older[suffix]
+		switch {
+		case !ok:
+			lines = append(lines, fmt.Sprintf("+%s%s:%s", prefix, suffix, count))
+		case old != count:
+			lines = append(lines, fmt.Sprintf("~%s%s:%s->%s", prefix, suffix, old, count))
+		}
+	}
+	for suffix, count := range older {
+		if _, ok := newer[suffix]; !ok {
+			lines = append(lines, fmt.Sprintf("-%s%s:%s", prefix, suffix, count))
+		}
+	}
+
+	// The lines are sorted by hash (ignoring the leading symbol) so that the
+	// output is deterministic.
+	slices.SortFunc(lines, func(x, y string) int { return strings.Compare(x[1:], y[1:]) })
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	return len(lines)
+}
+
+// memberIter walks the members of a tar in order. name is that of the current
+// member, or empty once there are none left.
+type memberIter struct {
+	f    *os.File
+	tr   *tar.Reader
+	name string
+}
+
+func openMembers(path string) (*memberIter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := decompress(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	m := &memberIter{f: f, tr: tar.NewReader(r)}
+	if err := m.advance(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading %q: %w", path, err)
+	}
+	return m, nil
+}
+
+func (m *memberIter) advance() error {
+	hdr, err := m.tr.Next()
+	if err == io.EOF {
+		m.name = ""
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	m.name = hdr.Name
+	return nil
+}
+
+// next returns the entries of the current member, by suffix, and moves on to
+// the next member.
+func (m *memberIter) next() (map[string]string, error) {
+	entries := make(map[string]string)
+	sc := bufio.NewScanner(m.tr)
+	for sc.Scan() {
+		suffix, count, ok := strings.Cut(strings.TrimSuffix(sc.Text(), "\r"), ":")
+		if !ok {
+			return nil, fmt.Errorf("member %s has a malformed line: %q", m.name, sc.Text())
+		}
+		entries[strings.ToUpper(suffix)] = count
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return entries, m.advance()
+}
+
+func (m *memberIter) close() error {
+	return m.f.Close()
+}
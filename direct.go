@@ -0,0 +1,80 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// getChunkDirect is the alternative to getChunk used under -direct. Rather than
+// filling a buffer for every range and then building the tar, each response is
+// written into the tar as soon as it and every range before it have arrived.
+// Only the ranges that arrive out of order are held in memory, so neither the
+// 4096-buffer pool nor the tar buffer is needed; the price is that the tar
+// writes are serialised behind a mutex.
+func (d *hibp) getChunkDirect(ctx context.Context, two int) error {
+	r := &reorderer{tw: tar.NewWriter(d.sink()), hdr: d.hdr, two: two, pending: map[int]*bytes.Buffer{}, pool: d.pool, manifest: d.manifest}
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(d.workers)
+	for j := 0x000; j <= 0xfff && ctx.Err() == nil; j++ {
+		three := j
+		eg.Go(func() error {
+			five := two*0x1000 + three
+			buf := d.pool.get()
+			if err := d.getOne(ctx, five, buf); err != nil {
+				return &rangeError{five: five, err: err}
+			}
+			return r.put(three, buf)
+		})
+	}
+
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	if err := r.tw.Flush(); err != nil {
+		return fmt.Errorf("writing the tar: %w", err)
+	}
+	if d.out != nil {
+		return d.out.flush(two)
+	}
+	return nil
+}
+
+// reorderer writes ranges into a tar in ascending order, whatever the order in
+// which they arrive.
+type reorderer struct {
+	mu      sync.Mutex
+	tw      *tar.Writer
+	hdr     tar.Header // The template for each member.
+	two     int
+	next    int // The next three-character suffix to be written.
+	pending map[int]*bytes.Buffer
+	pool    *bufPool
+
+	manifest *manifest // Optional; see -manifest.
+}
+
+func (r *reorderer) put(three int, buf *bytes.Buffer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pending[three] = buf
+	for {
+		buf, ok := r.pending[r.next]
+		if !ok {
+			return nil
+		}
+
+		if err := writeMember(r.tw, r.hdr, r.manifest, r.two*0x1000+r.next, int64(buf.Len()), bytes.NewReader(buf.Bytes())); err != nil {
+			return err
+		}
+
+		delete(r.pending, r.next)
+		r.pool.put(buf)
+		r.next++
+	}
+}
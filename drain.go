@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// errDrained is returned by run when it stops at a chunk boundary after a
+// signal under -drain-on-signal.
+var errDrained = errors.New("drained after a signal")
+
+// drainOnSignal arranges for the first SIGINT or SIGTERM to stop run from
+// starting any further chunks, while letting the current chunk finish and be
+// written. A second signal exits immediately.
+func (d *hibp) drainOnSignal() {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		slog.Warn("Draining: finishing the current chunk (signal again to abort)", slog.String("signal", sig.String()))
+		d.draining.Store(true)
+
+		sig = <-ch
+		slog.Error("Aborting", slog.String("signal", sig.String()))
+		os.Exit(1)
+	}()
+}
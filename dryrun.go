@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// dryRun logs what run would do, without making any requests or writing
+// anything. tarCap is the upper bound on the size of a chunk's tar, and others
+// are the paths of any other outputs.
+func (d *hibp) dryRun(tarCap int, others ...string) error {
+	start, resume, offset, err := d.startingPoint()
+	if err != nil {
+		return err
+	}
+
+	out := "discarded"
+	if d.outPath != "" {
+		out = d.outPath
+	}
+	var files []string
+	for _, path := range others {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	chunks := len(d.chunksFrom(start))
+	slog.Info("Would run",
+		slog.Int("chunks", chunks),
+		slog.Int("requests", chunks*0x1000),
+		slog.Int("workers", d.workers),
+		slog.String("base", d.base),
+		slog.String("mode", d.mode),
+		slog.String("output", out),
+		slog.Bool("resume", resume),
+		slog.Int64("resume_offset", offset),
+		slog.Any("other_outputs", files),
+		slog.Int64("max_output_bytes", int64(chunks)*int64(tarCap)))
+
+	for _, i := range d.chunksFrom(start) {
+		slog.Info("Would fetch a hash chunk",
+			slog.String("prefix", fmt.Sprintf("%02x", i)),
+			slog.String("first", d.rangeURL(i*0x1000)),
+			slog.String("last", d.rangeURL(i*0x1000+0xfff)))
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errUncached is returned for a 304 Not Modified when the range's previous
+// bytes aren't available; the range must then be fetched in full.
+var errUncached = errors.New("the range wasn't modified, but it isn't cached")
+
+// etags records a validator for each range in a sidecar file so that a later
+// run can make conditional requests, reusing the bytes of the unchanged ranges
+// from the previous tar rather than downloading them again. The validator is the
+// range's ETag or, for a server without them, its Last-Modified time; as an
+// ETag is always quoted, the two can't be confused.
+//
+// A validator is only good for the bytes it came with, so the sidecar is tied
+// to the tar it describes: its first line ("tar SIZE") records the size of the
+// tar, and it's only used with a -previous tar of that size. It's only written
+// once the run's tar is complete, and then only with the validators of the
+// ranges written to it.
+type etags struct {
+	path string
+
+	mu      sync.Mutex
+	tags    map[int]string // The validators of prev's ranges, by five-character prefix.
+	fresh   map[int]string // This run's validators, for the ranges not yet written.
+	written map[int]string // This run's validators, for the ranges written.
+
+	prev  *os.File         // Optional; the previous tar, read with ReadAt.
+	index map[int][2]int64 // The offset and size of each member of prev.
+	hits  atomic.Int64     // The ranges reused from prev.
+}
+
+// newETags indexes the previous tar at prevPath, if it's set, and loads the
+// validators at path that describe it. The previous tar must be uncompressed.
+func newETags(path, prevPath string) (*etags, error) {
+	e := &etags{path: path, tags: make(map[int]string), fresh: make(map[int]string), written: make(map[int]string)}
+	if prevPath == "" {
+		return e, nil
+	}
+
+	var err error
+	if e.prev, err = os.Open(prevPath); err != nil {
+		return nil, err
+	}
+	fi, err := e.prev.Stat()
+	if err != nil {
+		e.prev.Close()
+		return nil, err
+	}
+	if e.index, err = indexTar(e.prev); err != nil {
+		e.prev.Close()
+		return nil, fmt.Errorf("indexing %q: %w", prevPath, err)
+	}
+
+	size, err := loadETags(path, e.tags)
+	if err != nil {
+		e.prev.Close()
+		return nil, err
+	}
+	if size != fi.Size() {
+		slog.Warn("Ignoring ETags that don't describe the previous tar", slog.String("etags", path), slog.String("previous", prevPath),
+			slog.Int64("tar_bytes", size), slog.Int64("previous_bytes", fi.Size()))
+		clear(e.tags)
+	}
+	return e, nil
+}
+
+// loadETags reads the validators at path into tags, returning the size of the
+// tar they describe. It returns -1 if there's no file (or it predates the size
+// being recorded), which matches no tar.
+func loadETags(path string, tags map[int]string) (int64, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	size := int64(-1)
+	sc := bufio.NewScanner(f)
+	for first := true; sc.Scan(); first = false {
+		if first {
+			if _, err := fmt.Sscanf(sc.Text(), "tar %d", &size); err == nil {
+				continue
+			}
+		}
+		prefix, tag, ok := strings.Cut(sc.Text(), " ")
+		five, err := strconv.ParseUint(prefix, 16, 20)
+		if !ok || err != nil || len(prefix) != 5 {
+			return 0, fmt.Errorf("%q has a malformed line: %q", path, sc.Text())
+		}
+		tags[int(five)] = tag
+	}
+	return size, sc.Err()
+}
+
+// indexTar returns the offset and size of each range in the tar f.
+func indexTar(f *os.File) (map[int][2]int64, error) {
+	index := make(map[int][2]int64)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return index, nil
+		}
+		// A tar left by an interrupted run has no trailer, but everything up to
+		// that point is still usable.
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return index, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		five, err := strconv.ParseUint(hdr.Name, 16, 20)
+		if err != nil || len(hdr.Name) != 5 {
+			continue
+		}
+		// tar.Reader reads f directly, so f is now positioned at the member's
+		// data.
+		off, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		index[int(five)] = [2]int64{off, hdr.Size}
+	}
+}
+
+// cached returns the validator to send for a range, or the empty string if
+// there's none or there are no previous bytes to fall back on.
+func (e *etags) cached(five int) string {
+	if e == nil {
+		return ""
+	}
+	if _, ok := e.index[five]; !ok {
+		return ""
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.tags[five]
+}
+
+// copyPrevious writes the range's bytes from the previous tar to w.
+func (e *etags) copyPrevious(five int, w io.Writer) error {
+	span, ok := e.index[five]
+	if !ok {
+		return errUncached
+	}
+	if _, err := io.Copy(w, io.NewSectionReader(e.prev, span[0], span[1])); err != nil {
+		return fmt.Errorf("%w: %w", errUncached, err)
+	}
+	e.hits.Add(1)
+	return nil
+}
+
+// validatorOf returns the validator in a response's headers, preferring the
+// ETag, or the empty string if there's none.
+func validatorOf(h http.Header) string {
+	if tag := h.Get("ETag"); tag != "" {
+		return tag
+	}
+	// A time in the future (from a skewed clock) can't be trusted to mark a later
+	// change, so it isn't kept.
+	if t, err := http.ParseTime(h.Get("Last-Modified")); err == nil && !t.After(time.Now()) {
+		return t.UTC().Format(http.TimeFormat)
+	}
+	return ""
+}
+
+// set records the validator of the bytes fetched for a range. An empty
+// validator forgets the range.
+func (e *etags) set(five int, validator string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if validator == "" {
+		delete(e.fresh, five)
+	} else {
+		e.fresh[five] = validator
+	}
+}
+
+// delete forgets the validator of a range, as for one left empty under
+// -keep-going, so that a later run fetches it in full.
+func (e *etags) delete(five int) {
+	e.set(five, "")
+}
+
+// finish marks the ranges of the chunk with the given two-character prefix as
+// written to the tar.
+func (e *etags) finish(two int) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for five := two * 0x1000; five < (two+1)*0x1000; five++ {
+		if tag, ok := e.fresh[five]; ok {
+			e.written[five] = tag
+			delete(e.fresh, five)
+		}
+	}
+}
+
+// isETag reports whether a validator is an ETag rather than a time.
+func isETag(validator string) bool {
+	return strings.HasPrefix(validator, `"`) || strings.HasPrefix(validator, `W/"`)
+}
+
+// close atomically replaces the sidecar file with the validators of the ranges
+// written to the tar, which is tarSize bytes. If the tar isn't complete, the
+// file is left as it was.
+func (e *etags) close(complete bool, tarSize int64) error {
+	if e.prev != nil {
+		e.prev.Close()
+	}
+	if !complete {
+		return nil
+	}
+
+	f, err := createAtomic(e.path)
+	if err != nil {
+		return err
+	}
+
+	fives := make([]int, 0, len(e.written))
+	for five := range e.written {
+		fives = append(fives, five)
+	}
+	slices.Sort(fives)
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "tar %d\n", tarSize)
+	for _, five := range fives {
+		fmt.Fprintf(w, "%05x %s\n", five, e.written[five])
+	}
+	if err := w.Flush(); err != nil {
+		f.abort()
+		return err
+	}
+	return f.commit()
+}
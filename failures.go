@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+)
+
+// failures records the ranges that couldn't be fetched under -keep-going.
+type failures struct {
+	mu     sync.Mutex
+	prefix []int // By five-character prefix.
+}
+
+// add records a range that couldn't be fetched.
+func (f *failures) add(five int, err error) {
+	slog.Error("Skipping a range", slog.String("prefix", fmt.Sprintf("%05x", five)), slog.String("error", err.Error()))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prefix = append(f.prefix, five)
+}
+
+// write writes the failed prefixes to path, one per line, in ascending order.
+func (f *failures) write(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	slices.Sort(f.prefix)
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	for _, five := range f.prefix {
+		fmt.Fprintf(w, "%05x\n", five)
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (f *failures) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.prefix)
+}
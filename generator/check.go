@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+)
+
+// checkRanges checks that all 0x1000 ranges of each of the first prefixes
+// two-character prefixes are in rangeDir, as generate writes them, logging each
+// that's missing or truncated. In the raw format, a range must be exactly
+// rawRangeSize bytes; in the hibp format, whose lines vary in length, it must
+// have linesPerRange complete lines. It returns the number of problems.
+func checkRanges(rangeDir string, prefixes int, format string) (int, error) {
+	problems := 0
+	for i := 0; i < prefixes; i++ {
+		for j := 0x000; j <= 0xfff; j++ {
+			name := fmt.Sprintf("%02x%03x", i, j)
+			problem, err := checkRange(path.Join(rangeDir, name), format)
+			if err != nil {
+				return problems, err
+			}
+			if problem != "" {
+				slog.Error("Bad range", slog.String("prefix", name), slog.String("problem", problem))
+				problems++
+			}
+		}
+	}
+	return problems, nil
+}
+
+// checkRange returns what's wrong with the range at p, or the empty string if
+// nothing is.
+func checkRange(p, format string) (string, error) {
+	if format == "raw" {
+		fi, err := os.Stat(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return "missing", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Size() != rawRangeSize {
+			return fmt.Sprintf("%d bytes, not %d", fi.Size(), rawRangeSize), nil
+		}
+		return "", nil
+	}
+
+	bs, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "missing", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !bytes.HasSuffix(bs, []byte("\r\n")) {
+		return "the last line is incomplete", nil
+	}
+	if n := bytes.Count(bs, []byte("\r\n")); n != linesPerRange {
+		return fmt.Sprintf("%d lines, not %d", n, linesPerRange), nil
+	}
+	return "", nil
+}
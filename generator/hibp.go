@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// linesPerRange is roughly the number of entries in each of the real API's
+// ranges, which puts a range at about 32KB, as with the raw format.
+const linesPerRange = 800
+
+// source returns the source of randomness for a prefix: seeded with seed if
+// seeded is set, as in generate, or from crypto/rand otherwise.
+func source(seed int64, seeded bool) (*rand.Rand, error) {
+	if !seeded {
+		var bs [8]byte
+		if _, err := crand.Read(bs[:]); err != nil {
+			return nil, err
+		}
+		seed = int64(binary.LittleEndian.Uint64(bs[:]))
+	}
+	return rand.New(rand.NewSource(seed)), nil
+}
+
+// generateHIBP writes the ranges of the two-character prefix two to rangeDir
+// in the format of the API: sorted lines of "SUFFIX:COUNT\r\n", where SUFFIX is
+// the remaining suffixLen uppercase hexadecimal characters of a hash (35 for
+// SHA-1 and 27 for NTLM).
+func generateHIBP(rangeDir string, two, suffixLen int, r *rand.Rand) error {
+	var buf bytes.Buffer
+	suffixes := make([]string, linesPerRange)
+	bs := make([]byte, (suffixLen+1)/2) // Rounded up to a whole byte.
+	for j := 0x000; j <= 0xfff; j++ {
+		for k := range suffixes {
+			r.Read(bs)
+			suffixes[k] = strings.ToUpper(hex.EncodeToString(bs)[:suffixLen])
+		}
+		slices.Sort(suffixes)
+
+		buf.Reset()
+		for _, s := range suffixes {
+			fmt.Fprintf(&buf, "%s:%d\r\n", s, count(r))
+		}
+		if err := os.WriteFile(path.Join(rangeDir, fmt.Sprintf("%02x%03x", two, j)), buf.Bytes(), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// count returns a breach count from a Pareto distribution (with a minimum of
+// one and a shape of one), so that most counts are small and a few are very
+// large, as in the real data.
+func count(r *rand.Rand) int64 {
+	return int64(math.Floor(1 / (1 - r.Float64())))
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
-	"crypto/rand"
+	crand "crypto/rand"
 	"flag"
 	"fmt"
 	"log/slog"
+	"math/rand"
 	"os"
 	"path"
 	"runtime"
@@ -17,11 +18,42 @@ func main() {
 	var dir string
 	flag.IntVar(&prefixes, "p", 16, "Number of 2-digit prefixes to generate")
 	flag.StringVar(&dir, "d", ".", "Directory to write the ranges")
+	var format string
+	flag.StringVar(&format, "format", "raw", "The ranges to generate: raw (lines of random letters) or hibp (SUFFIX:COUNT lines, as from the API)")
+	var mode string
+	flag.StringVar(&mode, "mode", "sha1", "The hashes to generate: sha1 (into range) or ntlm (into range-ntlm, served for ?mode=ntlm)")
+	var seed int64
+	flag.Int64Var(&seed, "seed", 0, "Generate the same data for the same seed (by default, the data is cryptographically random)")
+	var check bool
+	flag.BoolVar(&check, "check", false, "Check that every range of the -p prefixes has been generated in full in the -format, rather than generating them")
+	var logFormat, logLevel string
+	flag.StringVar(&logFormat, "log-format", "text", "The format of the logs: text or json")
+	flag.StringVar(&logLevel, "log-level", "info", "The minimum level to log: debug, info, warn, or error")
 	flag.Parse()
+	slog.SetDefault(slog.New(newLogHandler(logFormat, logLevel)))
 	assert(prefixes > 0 && prefixes <= 256, "1..256 prefixes should be generated")
+	assert(format == "raw" || format == "hibp", "the format must be raw or hibp, not %q", format)
+	assert(mode == "sha1" || mode == "ntlm", "the mode must be sha1 or ntlm, not %q", mode)
+	rangeDir, suffixLen := path.Join(dir, "range"), 35
+	if mode == "ntlm" {
+		rangeDir, suffixLen = path.Join(dir, "range-ntlm"), 27
+	}
+
+	if check {
+		problems, err := checkRanges(rangeDir, prefixes, format)
+		assert(err == nil, "failed to check data: %v", err)
+		assert(problems == 0, "%q has %d missing or truncated ranges", rangeDir, problems)
+		slog.Info("Checked prefixes", slog.String("dir", rangeDir), slog.Int("prefixes", prefixes), slog.String("format", format))
+		return
+	}
+
+	// A seed of zero is a seed like any other, so it's whether the flag was
+	// given that matters.
+	seeded := false
+	flag.Visit(func(f *flag.Flag) { seeded = seeded || f.Name == "seed" })
 
-	slog.Info("Generating prefixes", slog.String("dir", dir), slog.Int("prefixes", prefixes))
-	err := generate(dir, prefixes)
+	slog.Info("Generating prefixes", slog.String("dir", rangeDir), slog.Int("prefixes", prefixes), slog.String("format", format), slog.String("mode", mode), slog.Bool("seeded", seeded), slog.Int64("seed", seed))
+	err := generate(rangeDir, prefixes, format, suffixLen, seed, seeded)
 	assert(err == nil, "failed to generate data: %v", err)
 	slog.Info("Finished generating prefixes")
 }
@@ -32,9 +64,12 @@ func assert(b bool, msg string, args ...any) {
 	}
 }
 
-func generate(dir string, prefixes int) error {
-	if err := os.MkdirAll(path.Join(dir, "range"), 0o755); err != nil {
-		return fmt.Errorf("%q could not created: %w", path.Join(dir, "range"), err)
+// rawRangeSize is the size of each range in the raw format.
+const rawRangeSize = 32_000
+
+func generate(rangeDir string, prefixes int, format string, suffixLen int, seed int64, seeded bool) error {
+	if err := os.MkdirAll(rangeDir, 0o755); err != nil {
+		return fmt.Errorf("%q could not created: %w", rangeDir, err)
 	}
 
 	var eg errgroup.Group
@@ -42,9 +77,21 @@ func generate(dir string, prefixes int) error {
 	for i := 0; i < prefixes; i++ {
 		i := i
 		eg.Go(func() error {
-			size := 32_000
+			if format == "hibp" {
+				r, err := source(seed+int64(i), seeded)
+				if err != nil {
+					return err
+				}
+				return generateHIBP(rangeDir, i, suffixLen, r)
+			}
+
+			size := rawRangeSize
 			bs := make([]byte, size*0x1000)
-			if _, err := rand.Read(bs); err != nil { // As math/rand.Read is deprecated(!).
+			if seeded {
+				// Each prefix i has its own source, seeded with seed+i, so that the
+				// data doesn't depend on the order in which the goroutines run.
+				rand.New(rand.NewSource(seed + int64(i))).Read(bs)
+			} else if _, err := crand.Read(bs); err != nil { // As math/rand.Read is deprecated(!).
 				return err
 			}
 
@@ -57,7 +104,7 @@ func generate(dir string, prefixes int) error {
 			}
 
 			for j := 0x000; j <= 0xfff; j++ {
-				f, err := os.Create(path.Join(dir, "range", fmt.Sprintf("%02x%03x", i, j)))
+				f, err := os.Create(path.Join(rangeDir, fmt.Sprintf("%02x%03x", i, j)))
 				if err != nil {
 					return err
 				}
@@ -72,3 +119,19 @@ func generate(dir string, prefixes int) error {
 
 	return eg.Wait()
 }
+
+// newLogHandler returns a handler writing to stderr in the given format (text
+// or json) that drops records below the given level (e.g., warn).
+func newLogHandler(format, level string) slog.Handler {
+	var l slog.Level
+	assert(l.UnmarshalText([]byte(level)) == nil, "the log level must be debug, info, warn, or error, not %q", level)
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		return slog.NewJSONHandler(os.Stderr, opts)
+	}
+	assert(false, "the log format must be text or json, not %q", format)
+	return nil
+}
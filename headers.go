@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// headerDump records the response headers (never the bodies) of a sample of
+// requests as JSON lines, e.g., for diagnosing inconsistent CDN behaviour.
+type headerDump struct {
+	rate float64
+
+	mu  sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+type headerRecord struct {
+	Prefix string      `json:"prefix"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+}
+
+func newHeaderDump(path string, rate float64) (*headerDump, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	return &headerDump{rate: rate, f: f, w: w, enc: json.NewEncoder(w)}, nil
+}
+
+func (h *headerDump) record(five int, resp *http.Response) error {
+	if rand.Float64() >= h.rate {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.enc.Encode(headerRecord{Prefix: fmt.Sprintf("%05x", five), Status: resp.StatusCode, Header: resp.Header})
+}
+
+func (h *headerDump) close() error {
+	if err := h.w.Flush(); err != nil {
+		return err
+	}
+	return h.f.Close()
+}
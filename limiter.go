@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// limiter paces events to a steady rate. It's shared by all of the workers:
+// each call to wait reserves the next free slot and then sleeps until it. It
+// plays the part of golang.org/x/time/rate's Limiter with a burst of one,
+// without the extra dependency.
+type limiter struct {
+	mu   sync.Mutex
+	per  float64   // The nanoseconds between events; a fraction for high rates (e.g., of bytes).
+	next time.Time // The earliest time at which the next event may happen.
+}
+
+// newLimiter returns a limiter allowing perSec events per second, or any number
+// of them if perSec is zero.
+func newLimiter(perSec float64) *limiter {
+	l := &limiter{}
+	l.setRate(perSec)
+	return l
+}
+
+// setRate changes the rate to perSec events per second, or lifts the limit if
+// perSec is zero.
+func (l *limiter) setRate(perSec float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.per = 0
+	if perSec > 0 {
+		l.per = float64(time.Second) / perSec
+	}
+}
+
+// wait blocks until n events are allowed to happen or the context is done.
+func (l *limiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(float64(n) * l.per))
+	l.mu.Unlock()
+
+	d := time.Until(at)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledReader reads from r no faster than l allows, taking a token per
+// byte, so that readers sharing l share its rate.
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Small reads keep the waits short, so the rate is smooth and a cancellation
+	// is noticed promptly.
+	if len(p) > 16<<10 {
+		p = p[:16<<10]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.l.wait(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// limits is what a cooperative mirror may advertise about how hard it's willing
+// to be hit, either as JSON at /limits (beside the range API, as in
+// https://mirror.example/limits for https://mirror.example/range) or in the
+// X-Concurrency-Limit and X-RPS-Limit headers of its responses. A zero limit
+// isn't advertised.
+type limits struct {
+	MaxConcurrency int     `json:"max_concurrency"`
+	MaxRPS         float64 `json:"max_rps"`
+}
+
+// fetchLimits asks the mirror serving base for its limits at /limits, falling
+// back to the headers of its first range if there's nothing there. It returns
+// the URL from which the limits came.
+func fetchLimits(client *http.Client, base string) (limits, string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return limits{}, "", err
+	}
+	at := u.ResolveReference(&url.URL{Path: "limits"}).String()
+	resp, err := client.Get(at)
+	if err != nil {
+		return limits{}, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		at = base + "/00000"
+		if resp, err = client.Head(at); err != nil {
+			return limits{}, "", err
+		}
+		resp.Body.Close()
+	}
+	if resp.StatusCode != http.StatusOK {
+		return limits{}, "", fmt.Errorf("unexpected status code (%d != 200) from %q", resp.StatusCode, at)
+	}
+
+	l, err := limitsFromHeader(resp.Header)
+	if err != nil {
+		return limits{}, "", err
+	}
+	if resp.Request.Method == http.MethodGet {
+		if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+			return limits{}, "", fmt.Errorf("decoding the limits: %w", err)
+		}
+	}
+	if l.MaxConcurrency < 0 || l.MaxRPS < 0 {
+		return limits{}, "", fmt.Errorf("the limits (%+v) must not be negative", l)
+	}
+	return l, at, nil
+}
+
+func limitsFromHeader(h http.Header) (limits, error) {
+	var l limits
+	if v := h.Get("X-Concurrency-Limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return limits{}, fmt.Errorf("parsing X-Concurrency-Limit: %w", err)
+		}
+		l.MaxConcurrency = n
+	}
+	if v := h.Get("X-RPS-Limit"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return limits{}, fmt.Errorf("parsing X-RPS-Limit: %w", err)
+		}
+		l.MaxRPS = n
+	}
+	return l, nil
+}
+
+// apply returns the configured number of workers and rate (where a zero rate is
+// unlimited), lowered to the limits where those are lower, and logs which are in
+// effect and why.
+func (l limits) apply(workers int, rps float64, from string) (int, float64) {
+	workersFrom, rpsFrom := "-workers", "-rps"
+	if l.MaxConcurrency > 0 && l.MaxConcurrency < workers {
+		workers, workersFrom = l.MaxConcurrency, from
+	}
+	if l.MaxRPS > 0 && (rps == 0 || l.MaxRPS < rps) {
+		rps, rpsFrom = l.MaxRPS, from
+	}
+	slog.Info("Limits in effect", slog.Int("workers", workers), slog.String("workers_from", workersFrom),
+		slog.Float64("rps", rps), slog.String("rps_from", rpsFrom))
+	return workers, rps
+}
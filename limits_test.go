@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetchLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		handle http.HandlerFunc
+		want   limits
+		from   string
+	}{
+		{"endpoint", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/limits" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(`{"max_concurrency": 8, "max_rps": 100}`))
+		}, limits{MaxConcurrency: 8, MaxRPS: 100}, "/limits"},
+		{"headers", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/range/00000" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("X-Concurrency-Limit", "4")
+			w.Header().Set("X-RPS-Limit", "2.5")
+		}, limits{MaxConcurrency: 4, MaxRPS: 2.5}, "/range/00000"},
+		{"none", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/range/00000" {
+				http.NotFound(w, r)
+			}
+		}, limits{}, "/range/00000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handle)
+			defer srv.Close()
+			got, from, err := fetchLimits(srv.Client(), srv.URL+"/range")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want || from != srv.URL+tt.from {
+				t.Fatalf("got %+v from %q, want %+v from %q", got, from, tt.want, srv.URL+tt.from)
+			}
+		})
+	}
+}
+
+func TestLimitsApply(t *testing.T) {
+	l := limits{MaxConcurrency: 8, MaxRPS: 100}
+	for _, tt := range []struct {
+		workers, wantWorkers int
+		rps, wantRPS         float64
+	}{
+		{64, 8, 0, 100},
+		{4, 4, 50, 50},
+		{16, 8, 200, 100},
+	} {
+		workers, rps := l.apply(tt.workers, tt.rps, "test")
+		if workers != tt.wantWorkers || rps != tt.wantRPS {
+			t.Errorf("applying %+v to %d workers at %v rps: got %d at %v, want %d at %v", l, tt.workers, tt.rps, workers, rps, tt.wantWorkers, tt.wantRPS)
+		}
+	}
+}
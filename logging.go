@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// coalescer wraps a slog.Handler so that a burst of similar warnings or errors
+// (e.g., every worker seeing a 503 during an outage) doesn't flood the logs.
+// The first record of a kind is passed through; repeats within the window are
+// counted and summarised in a single record once the window has passed.
+// Records are of the same kind if they share a level, a message, and (if
+// present) an "error" attribute.
+type coalescer struct {
+	next  slog.Handler
+	state *coalescerState
+}
+
+type coalescerState struct {
+	window time.Duration
+	mu     sync.Mutex
+	seen   map[coalescerKey]*coalesced
+}
+
+type coalescerKey struct {
+	level slog.Level
+	msg   string
+	err   string
+}
+
+type coalesced struct {
+	start      time.Time
+	suppressed int
+	next       slog.Handler // The handler to which the summary is written.
+}
+
+func newCoalescer(next slog.Handler, window time.Duration) *coalescer {
+	return &coalescer{next: next, state: &coalescerState{window: window, seen: map[coalescerKey]*coalesced{}}}
+}
+
+func (c *coalescer) Enabled(ctx context.Context, level slog.Level) bool {
+	return c.next.Enabled(ctx, level)
+}
+
+func (c *coalescer) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return c.next.Handle(ctx, r)
+	}
+
+	key := coalescerKey{level: r.Level, msg: r.Message}
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "error" {
+			key.err = a.Value.String()
+			return false
+		}
+		return true
+	})
+
+	s := c.state
+	s.mu.Lock()
+	e, ok := s.seen[key]
+	if ok && r.Time.Sub(e.start) < s.window {
+		e.suppressed++
+		s.mu.Unlock()
+		return nil
+	}
+	var summary *coalesced
+	if ok && e.suppressed > 0 {
+		summary = &coalesced{start: e.start, suppressed: e.suppressed, next: e.next}
+	}
+	s.seen[key] = &coalesced{start: r.Time, next: c.next}
+	s.mu.Unlock()
+
+	if summary != nil {
+		if err := summary.emit(ctx, key, r.Time); err != nil {
+			return err
+		}
+	}
+	return c.next.Handle(ctx, r)
+}
+
+func (c *coalescer) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &coalescer{next: c.next.WithAttrs(attrs), state: c.state}
+}
+
+func (c *coalescer) WithGroup(name string) slog.Handler {
+	return &coalescer{next: c.next.WithGroup(name), state: c.state}
+}
+
+// flush writes a summary for every kind of record that has been suppressed
+// since it was last passed through.
+func (c *coalescer) flush(ctx context.Context) error {
+	s := c.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, e := range s.seen {
+		if e.suppressed == 0 {
+			continue
+		}
+		if err := e.emit(ctx, key, now); err != nil {
+			return err
+		}
+		e.suppressed = 0
+	}
+	return nil
+}
+
+// flushExpired writes a summary for every kind of record whose window has
+// passed with repeats suppressed, and forgets every kind whose window has
+// passed, so that the next record of the kind is passed through. Otherwise, a
+// summary would wait for the next record of its kind, which may never come.
+func (c *coalescer) flushExpired(ctx context.Context, now time.Time) error {
+	s := c.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, e := range s.seen {
+		if now.Sub(e.start) < s.window {
+			continue
+		}
+		delete(s.seen, key)
+		if e.suppressed == 0 {
+			continue
+		}
+		if err := e.emit(ctx, key, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushEvery calls flushExpired once a window until stop is called, which
+// flushes whatever's left.
+func (c *coalescer) flushEvery() (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(c.state.window)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				c.flushExpired(context.Background(), now)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+		c.flush(context.Background())
+	}
+}
+
+func (e *coalesced) emit(ctx context.Context, key coalescerKey, now time.Time) error {
+	r := slog.NewRecord(now, key.level, "Suppressed repeated log lines", 0)
+	r.AddAttrs(slog.String("repeated", key.msg), slog.Int("count", e.suppressed), slog.Duration("over", now.Sub(e.start)))
+	if key.err != "" {
+		r.AddAttrs(slog.String("error", key.err))
+	}
+	return e.next.Handle(ctx, r)
+}
+
+// newLogHandler returns a handler writing to stderr in the given format (text
+// or json) that drops records below the given level (e.g., warn).
+func newLogHandler(format, level string) slog.Handler {
+	var l slog.Level
+	assert(l.UnmarshalText([]byte(level)) == nil, "the log level must be debug, info, warn, or error, not %q", level)
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		return slog.NewJSONHandler(os.Stderr, opts)
+	}
+	assert(false, "the log format must be text or json, not %q", format)
+	return nil
+}
+
+// errorJSON is the final error of a failed run as it's written under
+// -log-format json, with what's known of where it happened.
+type errorJSON struct {
+	Error  string `json:"error"`
+	Prefix string `json:"prefix,omitempty"` // Of the chunk.
+	Range  string `json:"range,omitempty"`  // The five-character prefix.
+	Code   int    `json:"code,omitempty"`   // The HTTP status of the last response.
+}
+
+// writeErrorJSON writes err to w as a line of JSON.
+func writeErrorJSON(w io.Writer, err error) {
+	e := errorJSON{Error: err.Error()}
+	var rerr *rangeError
+	if errors.As(err, &rerr) {
+		e.Prefix, e.Range = fmt.Sprintf("%02x", rerr.five>>12), fmt.Sprintf("%05x", rerr.five)
+	}
+	var serr *statusError
+	if errors.As(err, &serr) {
+		e.Code = serr.code
+	}
+	json.NewEncoder(w).Encode(e)
+}
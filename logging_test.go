@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCoalescerFlushExpired(t *testing.T) {
+	var buf bytes.Buffer
+	c := newCoalescer(slog.NewTextHandler(&buf, nil), time.Minute)
+	ctx := context.Background()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		r := slog.NewRecord(start.Add(time.Duration(i)*time.Second), slog.LevelWarn, "Retrying a range", 0)
+		if err := c.Handle(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Fatalf("got %d lines before the window passed, want the first record alone:\n%s", n, buf.String())
+	}
+
+	// Within the window, nothing is flushed; once it's passed, the repeats are
+	// summarised without waiting for another record.
+	if err := c.flushExpired(ctx, start.Add(30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "Suppressed") {
+		t.Fatalf("got a summary within the window:\n%s", buf.String())
+	}
+	if err := c.flushExpired(ctx, start.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `msg="Suppressed repeated log lines" repeated="Retrying a range" count=2`) {
+		t.Fatalf("got no summary once the window passed:\n%s", buf.String())
+	}
+
+	// The kind was forgotten, so its next record is passed through.
+	buf.Reset()
+	if err := c.Handle(ctx, slog.NewRecord(start.Add(61*time.Second), slog.LevelWarn, "Retrying a range", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `msg="Retrying a range"`) || strings.Contains(buf.String(), "Suppressed") {
+		t.Fatalf("got %q, want the record passed through alone", buf.String())
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// errNoMember is returned by lookup when the archive has no member for the
+// password's prefix, i.e., its range wasn't downloaded.
+var errNoMember = errors.New("the archive has no member for the prefix")
+
+// lookup returns the number of times password appears in the breaches, per the
+// archive at path (as written with -o, with or without -gzip). The password is
+// hashed as the archive's were, per the mode recorded alongside it; an archive
+// without one holds SHA-1 hashes.
+func lookup(path, password string) (int, error) {
+	mode, err := archiveMode(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var hash string
+	switch mode {
+	case "sha1":
+		hash = fmt.Sprintf("%X", sha1.Sum([]byte(password)))
+	case "ntlm":
+		hash = fmt.Sprintf("%X", ntlmHash(password))
+	default:
+		return 0, fmt.Errorf("%q holds hashes of an unknown mode (%q)", path, mode)
+	}
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r, err := decompress(f)
+	if err != nil {
+		return 0, err
+	}
+
+	// The members are named as in tar: the five-character prefix in lowercase.
+	name := strings.ToLower(prefix)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return 0, fmt.Errorf("%w %s", errNoMember, name)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if hdr.Name == name {
+			return scanRange(tr, suffix)
+		}
+	}
+}
+
+// archiveMode returns the mode (sha1 or ntlm) recorded alongside the archive at
+// path by writeMode; an archive without one holds SHA-1 hashes.
+func archiveMode(path string) (string, error) {
+	bs, err := os.ReadFile(path + ".mode")
+	if errors.Is(err, fs.ErrNotExist) {
+		return "sha1", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(bs)), nil
+}
+
+// decompress returns a reader of the tar in f, which may be gzipped.
+func decompress(f *os.File) (io.Reader, error) {
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return gzip.NewReader(br)
+	}
+	// An uncompressed tar is read directly, as tar.Reader can then seek past the
+	// members it doesn't need.
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// gunzipped returns a reader of what r holds, which may be gzipped.
+func gunzipped(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// scanRange returns the count for suffix in a range body of SUFFIX:COUNT lines,
+// or zero if it's absent.
+func scanRange(r io.Reader, suffix string) (int, error) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		s, count, ok := strings.Cut(strings.TrimSpace(sc.Text()), ":")
+		if !ok || !strings.EqualFold(s, suffix) {
+			continue
+		}
+		return strconv.Atoi(count)
+	}
+	return 0, sc.Err()
+}
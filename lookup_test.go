@@ -0,0 +1,58 @@
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLookupNTLM(t *testing.T) {
+	// The NTLM hash of "password" is 8846F7EAEE8FB117AD06BDD830B7586C.
+	path := filepath.Join(t.TempDir(), "hibp.tar")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	body := "00000000000000000000000000A:1\r\n7EAEE8FB117AD06BDD830B7586C:2345\r\n"
+	if err := tw.WriteHeader(&tar.Header{Name: "8846f", Mode: 0o644, Size: int64(len(body))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMode(path, "ntlm", false); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := lookup(path, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2345 {
+		t.Fatalf("got a count of %d, want 2345", count)
+	}
+	var sb strings.Builder
+	if err := newVerdict(count).write(&sb); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sb.String(), `{"pwned":true,"count":2345,"severity":"high"}`+"\n"; got != want {
+		t.Fatalf("got the verdict %s, want %s", got, want)
+	}
+}
+
+func TestVerdictSeverity(t *testing.T) {
+	for count, want := range map[int]string{0: "none", 1: "low", 9: "low", 10: "medium", 999: "medium", 1000: "high", 100_000: "critical"} {
+		if got := newVerdict(count).Severity; got != want {
+			t.Errorf("got a severity of %q for a count of %d, want %q", got, count, want)
+		}
+	}
+}
@@ -2,44 +2,427 @@ package main
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"runtime"
+	"runtime/debug"
 	"runtime/pprof"
 	"runtime/trace"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"golang.org/x/sync/errgroup"
 )
 
-const (
-	base    = "http://localhost:8009/range"
-	workers = 64
-)
+// doer sends HTTP requests. It's satisfied by *http.Client, and lets the
+// requests be made by a fake in place of a real server.
+type doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// rangeError is the error for a range that couldn't be fetched.
+type rangeError struct {
+	five int
+	err  error
+}
+
+func (e *rangeError) Error() string {
+	return fmt.Sprintf("fetching hashes for prefix %05x: %v", e.five, e.err)
+}
+
+func (e *rangeError) Unwrap() error { return e.err }
+
+// statusError is the error for a response with a status other than 200.
+type statusError struct{ code int }
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status code (%d != 200)", e.code)
+}
 
 type hibp struct {
-	prefixes int
-	manual   bool
-	client   http.Client
-	bufs     []*bytes.Buffer
-	tarBuf   *bytes.Buffer
+	chunks  []int // The two-character prefixes to fetch, in ascending order.
+	workers int
+	manual  bool
+
+	base         string
+	userAgent    string
+	mode         string // The hash: sha1 or ntlm.
+	padding      bool   // See -padding.
+	validate     bool   // See -validate.
+	client       doer
+	timeout      time.Duration // For each request, including the body.
+	retry        RetryPolicy
+	retryBudget  time.Duration    // The time a range may spend retrying; see -retry-budget.
+	maxThrottled int              // The number of 429s with a Retry-After to wait out per range.
+	limiter      *limiter         // Optional; see -rps.
+	throttle     *latencyThrottle // Optional; see -throttle-latency.
+	bwLimiter    *limiter         // Optional; see -bwlimit.
+	maxRange     int64            // The largest range body to accept.
+	meta         *meta            // Optional; see -meta-url.
+
+	bufs      []*bytes.Buffer
+	spare     []*bytes.Buffer // The second set of buffers under -overlap.
+	tarBuf    *bytes.Buffer
+	members   *members    // Optional; see -gz.
+	text      *text       // Optional; see -git-friendly.
+	outDir    *outDir     // Optional; see -out-dir.
+	tarDir    *tarDir     // Optional; see -tar-dir.
+	headers   *headerDump // Optional; see -dump-headers.
+	etags     *etags      // Optional; see -etags.
+	manifest  *manifest   // Optional; see -manifest.
+	outPath   string      // Optional; see -o.
+	gzip      int         // The gzip level for the output, if nonzero; see -gzip.
+	hdr       tar.Header  // The template for each member; see -mtime and -file-mode.
+	out       *output     // Opened by run if outPath is set.
+	statePath string      // Optional; see -state.
+	restart   bool        // See -restart.
+	resume    bool        // See -resume.
+
+	stats         stats
+	statsInterval time.Duration
+	metricsAddr   string     // Optional; see -metrics-addr.
+	reportPath    string     // Optional; see -report.
+	gzipReport    bool       // See -compress-manifest.
+	conns         *connStats // Optional; see -conntrace.
+
+	direct   bool     // See -direct.
+	stream   bool     // See -stream.
+	pipeline int      // The chunks to fetch at once under -pipeline.
+	overlap  bool     // See -overlap.
+	pool     *bufPool // Buffers for the ranges.
+
+	draining     atomic.Bool // Set under -drain-on-signal once a signal arrives.
+	clockChecked atomic.Bool // Set by checkClock on the first response.
+
+	keepGoing bool     // See -keep-going.
+	failures  failures // The ranges skipped under -keep-going.
 }
 
 func main() {
+	// This is deferred first so that it runs last, after the outputs and profiles
+	// have been closed.
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
 	var prefixes int
 	flag.IntVar(&prefixes, "p", 0, "The number of prefixes to handle")
+	var prefixList string
+	flag.StringVar(&prefixList, "prefixes", "", "The prefixes to handle, rather than the first -p (e.g., 00-0f,a3,ff, or @file with a prefix per line, as in a -failures file)")
+	var workers int
+	flag.IntVar(&workers, "workers", 64, "The number of concurrent requests")
+	var proxy string
+	flag.StringVar(&proxy, "proxy", "", "The URL of a proxy for the requests (by default, HTTP_PROXY, HTTPS_PROXY, and NO_PROXY are used)")
+	var bwLimit string
+	flag.StringVar(&bwLimit, "bwlimit", "", "The maximum bytes per second to read across all workers (e.g., 10MiB; by default, it's unlimited)")
+	var maxRange string
+	flag.StringVar(&maxRange, "max-range-bytes", "1MiB", "Reject a range whose body is larger than this")
+	var maxIdle int
+	var idleTimeout time.Duration
+	flag.IntVar(&maxIdle, "max-idle-conns", 0, "The maximum number of idle connections to keep open (0 is one per worker)")
+	flag.DurationVar(&idleTimeout, "idle-conn-timeout", 90*time.Second, "How long to keep an idle connection open (0 is indefinitely)")
+	var dialTimeout, headerTimeout, requestTimeout time.Duration
+	flag.DurationVar(&dialTimeout, "dial-timeout", 30*time.Second, "The timeout for connecting to the server")
+	flag.DurationVar(&headerTimeout, "response-header-timeout", 0, "The timeout for a response's headers once a request is sent (0 is only bounded by -request-timeout)")
+	flag.DurationVar(&requestTimeout, "request-timeout", 30*time.Second, "The timeout for each request, including reading the body")
+	var noGzip bool
+	flag.BoolVar(&noGzip, "no-gzip", false, "Don't ask the server to compress the ranges (by default, gzip is accepted and decompressed transparently)")
+	var rps float64
+	flag.Float64Var(&rps, "rps", 0, "The maximum number of requests per second across all workers (0 is unlimited)")
+	var throttleLatency time.Duration
+	flag.DurationVar(&throttleLatency, "throttle-latency", 0, "Halve the request rate while the mean latency exceeds this, restoring it once the latency falls below half of it (0 disables this)")
+	var base, userAgent string
+	defaultBase := "http://localhost:8009/range"
+	if env := os.Getenv("HIBP_BASE"); env != "" {
+		defaultBase = env
+	}
+	flag.StringVar(&base, "base", defaultBase, "The base URL of the range API (e.g., https://api.pwnedpasswords.com/range); by default, $HIBP_BASE if it's set")
+	flag.StringVar(&userAgent, "user-agent", "hibp-mirror/"+version, "The User-Agent header to send (the real API requires one)")
+	var mode string
+	flag.StringVar(&mode, "mode", "sha1", "The hashes to fetch: sha1 or ntlm")
+	var padding bool
+	flag.BoolVar(&padding, "padding", false, "Ask the API to pad its responses (and drop the padding)")
+	var validate bool
+	flag.BoolVar(&validate, "validate", false, "Check that every line of every response is a well-formed SUFFIX:COUNT entry, with a suffix that completes a hash of the -mode (e.g., 35 hexadecimal characters for sha1)")
 	var profile, manual bool
 	flag.BoolVar(&manual, "manual", false, "Manually invoke the GC?")
 	flag.BoolVar(&profile, "profile", false, "Collect a memory profile and a trace?")
+	var memLimit string
+	flag.StringVar(&memLimit, "mem-limit", "", "A soft memory limit for the runtime (e.g., 450MiB); see GOMEMLIMIT")
+	var gzPath, gzRead string
+	flag.StringVar(&gzPath, "gz", "", "Also write each range as a gzip member of this file (with an index alongside)")
+	flag.StringVar(&gzRead, "gz-read", "", "Print the range for this five-character prefix from the -gz file and exit")
+	var outPath string
+	flag.StringVar(&outPath, "o", "", "Write the tar to this file, or to a consumer listening on a Unix socket with unix:PATH (by default, it's discarded)")
+	var outDirPath string
+	var shard bool
+	flag.StringVar(&outDirPath, "out-dir", "", "Write each range to its own file in this directory rather than writing a tar")
+	var tarDirPath string
+	flag.StringVar(&tarDirPath, "tar-dir", "", "Also write each chunk as a tar of its own to this directory, renaming each into place once it's complete")
+	flag.BoolVar(&shard, "shard", false, "Split the -out-dir files into a subdirectory per two-character prefix")
+	var skipExisting bool
+	flag.BoolVar(&skipExisting, "skip-existing", false, "Leave the -out-dir files that already have the range's size alone rather than rewriting them")
+	var manifestPath string
+	var verifyOnly bool
+	flag.StringVar(&manifestPath, "manifest", "", "Record the SHA-256 and length of every range in the -o tar in this file")
+	flag.BoolVar(&verifyOnly, "verify", false, "Check the -o tar against the -manifest and exit")
+	var compressManifest bool
+	flag.BoolVar(&compressManifest, "compress-manifest", false, "Compress the -manifest and -report files with gzip (-verify and -resume read either)")
+	var diffPath string
+	flag.StringVar(&diffPath, "diff", "", "Print the hashes added, removed, or changed between this older tar and the -o tar, and exit")
+	var password string
+	flag.StringVar(&password, "lookup", "", "Print the breach count for this password from the -o tar and exit (- reads it from stdin)")
+	var printVerdict bool
+	flag.BoolVar(&printVerdict, "verdict", false, "With -lookup, print a JSON verdict (whether the password's pwned, its count, and a severity) rather than the count")
+	var statePath string
+	var restart bool
+	flag.StringVar(&statePath, "state", "", "Record progress in this file after each chunk and resume from it")
+	flag.BoolVar(&restart, "restart", false, "Ignore (and replace) any existing -state and start from the first prefix")
+	var resumeTar bool
+	flag.BoolVar(&resumeTar, "resume", false, "Resume after the last complete chunk of the -o tar, found by checking the tar itself rather than -state, or skip the chunks already in -tar-dir")
+	var gzipOut bool
+	var gzipLevel int
+	flag.BoolVar(&gzipOut, "gzip", false, "Compress the -o output (and the -tar-dir tars) with gzip")
+	flag.IntVar(&gzipLevel, "gzip-level", 6, "The gzip compression level (1..9)")
+	var mtime, fileMode string
+	flag.StringVar(&mtime, "mtime", "", "The modification time of every member of the tar, in RFC 3339 (e.g., 2024-01-01T00:00:00Z); by default, the start of the run")
+	flag.StringVar(&fileMode, "file-mode", "0600", "The mode of every member of the tar, in octal")
+	var textPath, fieldSep, lineSep string
+	flag.StringVar(&textPath, "git-friendly", "", "Also write every entry as sorted, diff-friendly text to this file")
+	flag.StringVar(&fieldSep, "field-sep", ":", "The separator between the hash and the count in text output (Go escapes allowed)")
+	flag.StringVar(&lineSep, "line-sep", `\n`, "The line terminator in text output (Go escapes allowed, e.g., \\r\\n)")
+	var statsInterval time.Duration
+	flag.DurationVar(&statsInterval, "stats-interval", 0, "Log the throughput at this interval (0 disables this)")
+	var reportPath string
+	flag.StringVar(&reportPath, "report", "", "Also write the summary of the run to this file as JSON")
+	var connTrace bool
+	flag.BoolVar(&connTrace, "conntrace", false, "Count the connections reused and dialed (with their DNS lookups and TLS handshakes), and record the TLS version, cipher suite, and certificate expiry, for the report")
+	var metricsAddr string
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Serve Prometheus metrics at /metrics on this address (e.g., localhost:9090)")
+	var retryName string
+	var retries int
+	flag.StringVar(&retryName, "retry-policy", "exponential", "How to retry failed requests: none, fixed, exponential, or jitter")
+	flag.IntVar(&retries, "retries", 3, "The maximum number of times to retry a failed request")
+	var retryBudget time.Duration
+	flag.DurationVar(&retryBudget, "retry-budget", 2*time.Minute, "The longest a range may go on being retried, from its first failure")
+	var maxThrottled int
+	flag.IntVar(&maxThrottled, "max-throttled", 10, "The maximum number of times to honour a 429's Retry-After for a range")
+	var direct bool
+	flag.BoolVar(&direct, "direct", false, "Write each response into the tar as it arrives rather than buffering the chunk")
+	var stream bool
+	flag.BoolVar(&stream, "stream", false, "Write each response to a temporary file and build the tar from those rather than buffering the chunk")
+	var pipeline int
+	flag.IntVar(&pipeline, "pipeline", 0, "Fetch up to this many chunks at once, sharing the workers, and write them in order (0 disables this)")
+	var overlap bool
+	flag.BoolVar(&overlap, "overlap", false, "Fetch the next chunk into a second set of buffers while the last is written")
+	var headersPath string
+	var headersRate float64
+	flag.StringVar(&headersPath, "dump-headers", "", "Record the response headers of a sample of requests to this file")
+	flag.Float64Var(&headersRate, "dump-rate", 0.01, "The fraction of requests whose headers are recorded under -dump-headers")
+	var etagsPath, prevPath string
+	flag.StringVar(&etagsPath, "etags", "", "Record each range's ETag (or Last-Modified) in this file and make conditional requests with them")
+	flag.StringVar(&prevPath, "previous", "", "Reuse the unchanged ranges from this (uncompressed) tar under -etags")
+	var limitsFromServer bool
+	flag.BoolVar(&limitsFromServer, "concurrency-limit-from-server", false, "Keep -workers and -rps within the limits the server advertises, at /limits beside -base or in its headers")
+	var metaURL string
+	flag.StringVar(&metaURL, "meta-url", "", "A URL serving the dataset's metadata, used to size the buffers")
+	var drain bool
+	flag.BoolVar(&drain, "drain-on-signal", false, "On SIGINT or SIGTERM, finish and write the current chunk before exiting")
+	var keepGoing bool
+	var failuresPath string
+	flag.BoolVar(&keepGoing, "keep-going", false, "Leave a range that can't be fetched empty and carry on, exiting non-zero at the end")
+	flag.StringVar(&failuresPath, "failures", "", "Write the prefixes of the ranges skipped under -keep-going to this file")
+	var sampleN int
+	flag.IntVar(&sampleN, "sample-verify", 0, "Check this many hashes, picked at random from the -o tar, against the live API, log the match rate, and exit")
+	var dryRun bool
+	flag.BoolVar(&dryRun, "dry-run", false, "Log what would be fetched and written, and exit without making any requests")
+	var showVersion bool
+	flag.BoolVar(&showVersion, "version", false, "Print the version and exit")
+	var logWindow time.Duration
+	flag.DurationVar(&logWindow, "log-window", 10*time.Second, "Coalesce repeated warnings and errors over this window (0 disables this)")
+	var logFormat, logLevel string
+	flag.StringVar(&logFormat, "log-format", "text", "The format of the logs: text or json")
+	flag.StringVar(&logLevel, "log-level", "info", "The minimum level to log: debug, info, warn, or error")
 	flag.Parse()
-	assert(prefixes > 0, "the number of prefixes must be positive")
+	if gzipOut {
+		assert(outPath != "" || tarDirPath != "", "-gzip requires -o or -tar-dir")
+		assert(gzipLevel >= gzip.BestSpeed && gzipLevel <= gzip.BestCompression, "the gzip level must be in %d..%d", gzip.BestSpeed, gzip.BestCompression)
+	} else {
+		gzipLevel = 0
+	}
+
+	if showVersion {
+		fmt.Println(buildInfo())
+		return
+	}
+
+	handler := newLogHandler(logFormat, logLevel)
+	if logWindow > 0 {
+		c := newCoalescer(handler, logWindow)
+		slog.SetDefault(slog.New(c))
+		stop := c.flushEvery()
+		defer stop()
+	} else {
+		slog.SetDefault(slog.New(handler))
+	}
+
+	retry, err := newRetryPolicy(retryName, retries)
+	assert(err == nil, "%v", err)
+	assert(retryBudget >= 0, "the retry budget must not be negative")
+	assert(headersRate >= 0 && headersRate <= 1, "the header dump rate must be in [0, 1]")
+
+	if gzRead != "" {
+		assert(gzPath != "", "-gz-read requires -gz")
+		err := readMember(gzPath, gzRead, os.Stdout)
+		assert(err == nil, "reading %s from %q: %v", gzRead, gzPath, err)
+		return
+	}
+	if verifyOnly {
+		assert(outPath != "" && manifestPath != "", "-verify requires -o and -manifest")
+		problems, err := verify(outPath, manifestPath)
+		assert(err == nil, "verifying %q: %v", outPath, err)
+		assert(problems == 0, "%q doesn't match %q (%d problems)", outPath, manifestPath, problems)
+		slog.Info("Verified the tar against the manifest", slog.String("tar", outPath), slog.String("manifest", manifestPath))
+		return
+	}
+	if diffPath != "" {
+		assert(outPath != "", "-diff requires -o")
+		changes, err := diffTars(diffPath, outPath, os.Stdout)
+		assert(err == nil, "comparing %q with %q: %v", diffPath, outPath, err)
+		slog.Info("Compared the tars", slog.String("old", diffPath), slog.String("new", outPath), slog.Int("changes", changes))
+		if changes > 0 {
+			exitCode = 1 // As with diff(1).
+		}
+		return
+	}
+	if password != "" {
+		assert(outPath != "", "-lookup requires -o")
+		if password == "-" {
+			sc := bufio.NewScanner(os.Stdin)
+			sc.Scan()
+			assert(sc.Err() == nil, "reading the password: %v", sc.Err())
+			password = sc.Text()
+		}
+		count, err := lookup(outPath, password)
+		assert(err == nil, "looking up the password in %q: %v", outPath, err)
+		if printVerdict {
+			err := newVerdict(count).write(os.Stdout)
+			assert(err == nil, "writing the verdict: %v", err)
+			return
+		}
+		fmt.Println(count)
+		return
+	}
+	assert(!printVerdict, "-verdict requires -lookup")
+	// There are exactly 256 two-character prefixes; beyond that, the %02x naming
+	// of the chunks would request ranges that don't exist.
+	var chunks []int
+	if prefixList != "" {
+		assert(prefixes == 0, "-p can't be combined with -prefixes")
+		var err error
+		chunks, err = parsePrefixes(prefixList)
+		assert(err == nil && len(chunks) > 0, "parsing -prefixes: %v", err)
+	} else {
+		assert(prefixes > 0 && prefixes <= 0x100, "1..256 prefixes should be handled")
+		for i := 0; i < prefixes; i++ {
+			chunks = append(chunks, i)
+		}
+	}
+	assert(workers > 0, "the number of workers must be positive")
+	assert(mode == "sha1" || mode == "ntlm", "the mode must be sha1 or ntlm, not %q", mode)
+	assert(rps >= 0, "the request rate must not be negative")
+	assert(throttleLatency >= 0, "the throttling latency must not be negative")
+	assert(maxThrottled >= 0, "the number of 429s to wait out must not be negative")
+	assert(maxIdle >= 0, "the number of idle connections must not be negative")
+	assert(dialTimeout > 0 && requestTimeout > 0, "the dial and request timeouts must be positive")
+	assert(headerTimeout >= 0, "the response header timeout must not be negative")
+	assert(pipeline >= 0, "the number of chunks to pipeline must not be negative")
+	maxRangeBytes, err := parseBytes(maxRange)
+	assert(err == nil, "parsing the maximum range size: %v", err)
+	var bwPerSec int64
+	if bwLimit != "" {
+		bwPerSec, err = parseBytes(bwLimit)
+		assert(err == nil, "parsing the bandwidth limit: %v", err)
+	}
+	var proxyURL *url.URL
+	if proxy != "" {
+		proxyURL, err = url.Parse(proxy)
+		assert(err == nil && proxyURL.Host != "", "the proxy %q must be a URL (e.g., http://proxy.example:3128)", proxy)
+	}
+
+	// The combinations of flags are checked before anything is fetched or any
+	// file is created, so that a bad invocation (even under -dry-run) fails
+	// without side effects.
+	if direct || stream {
+		assert(!(direct && stream), "-direct can't be combined with -stream")
+		assert(gzPath == "" && textPath == "" && outDirPath == "" && tarDirPath == "", "-direct and -stream can't be combined with -gz, -git-friendly, -out-dir, or -tar-dir")
+		assert(pipeline == 0, "-direct and -stream can't be combined with -pipeline")
+		assert(!overlap, "-direct and -stream can't be combined with -overlap")
+	}
+	assert(!overlap || pipeline == 0, "-overlap can't be combined with -pipeline")
+	assert(outDirPath == "" || outPath == "", "-out-dir can't be combined with -o")
+	assert(outDirPath != "" || (!shard && !skipExisting), "-shard and -skip-existing require -out-dir")
+	assert(keepGoing || failuresPath == "", "-failures requires -keep-going")
+	assert(!resumeTar || (outPath != "" && !gzipOut) || (outPath == "" && tarDirPath != ""), "-resume requires an uncompressed -o tar or -tar-dir")
+	if _, ok := socketAddr(outPath); ok {
+		// A stream can't be appended to or read back.
+		assert(!resumeTar && statePath == "" && etagsPath == "", "-o unix:PATH can't be combined with -resume, -state, or -etags")
+	}
+	// Resuming from -tar-dir skips chunks wherever they are, which the -gz and
+	// -git-friendly files, written in order, can't.
+	assert(!resumeTar || outPath != "" || (gzPath == "" && textPath == ""), "-resume with -tar-dir (and no -o) can't be combined with -gz or -git-friendly")
+	assert(!compressManifest || manifestPath != "" || reportPath != "", "-compress-manifest requires -manifest or -report")
+	assert(manifestPath == "" || outPath != "", "-manifest requires -o")
+	if etagsPath != "" {
+		// The ETags describe the -o tar, which must be usable as a -previous tar.
+		assert(outPath != "" && !gzipOut, "-etags requires an uncompressed -o tar")
+		assert(prevPath != outPath, "-previous must differ from -o, which is overwritten")
+	} else {
+		assert(prevPath == "", "-previous requires -etags")
+	}
+	var txt *text
+	if textPath != "" {
+		fieldSep, err := unescape(fieldSep)
+		assert(err == nil, "parsing -field-sep: %v", err)
+		lineSep, err := unescape(lineSep)
+		assert(err == nil, "parsing -line-sep: %v", err)
+		txt, err = newText(textPath, fieldSep, lineSep)
+		assert(err == nil, "%v", err)
+	}
+
+	u, err := url.Parse(base)
+	assert(err == nil && (u.Scheme == "http" || u.Scheme == "https"), "the base URL %q must be an http(s) URL", base)
+
+	slog.Info("Starting", slog.Int("prefixes", len(chunks)), slog.Int("workers", workers), slog.Float64("rps", rps), slog.String("mode", mode), slog.String("base", base), slog.Bool("profile", profile), slog.Bool("manual", manual))
 
-	slog.Info("Starting", slog.Int("prefixes", prefixes), slog.Bool("profile", profile), slog.Bool("manual", manual))
+	if memLimit != "" {
+		limit, err := parseBytes(memLimit)
+		assert(err == nil, "parsing the memory limit: %v", err)
+		// The preallocated buffers below are live for the whole run, so a limit
+		// close to their size leaves the GC running almost continuously.
+		debug.SetMemoryLimit(limit)
+		slog.Info("Set a soft memory limit", slog.Int64("bytes", limit))
+	}
 
 	if profile {
 		tr, err := os.Create("./trace.out")
@@ -55,30 +438,324 @@ func main() {
 		defer f.Close()
 
 		defer func() {
+			// These allow the allocations of different modes to be compared without
+			// opening the profile.
+			var ms runtime.MemStats
+			runtime.ReadMemStats(&ms)
+			slog.Info("Allocations", slog.Uint64("mallocs", ms.Mallocs), slog.Uint64("total_alloc_bytes", ms.TotalAlloc))
+
 			runtime.GC()
 			err = pprof.WriteHeapProfile(f)
 			assert(err == nil, "writing the heap profile: %v", err)
 		}()
 	}
 
-	bufs := make([]*bytes.Buffer, 0x1000)
-	for i := range bufs {
-		bs := make([]byte, 0, 48_000) // A loose per-request upper bound.
-		bufs[i] = bytes.NewBuffer(bs)
+	// The default transport keeps only two idle connections per host, so most of
+	// the workers would otherwise open a new connection for every request. The
+	// transport is shared by every request (through the client).
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.IdleConnTimeout = idleTimeout
+	// A dead server fails at the dial or while waiting for the headers; a slow
+	// body is bounded by the per-request deadline set in fetchOnce.
+	transport.DialContext = (&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.ResponseHeaderTimeout = headerTimeout
+	transport.DisableCompression = noGzip
+	if proxyURL != nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
 	}
-
-	bs := make([]byte, 0, 160_000_000) // A loose upper bound for the tar.
-	tarBuf := bytes.NewBuffer(bs)
+	// The proxy is the one for the first range, which (with the environment's
+	// NO_PROXY) is the one for every range.
+	req, err := http.NewRequest("GET", base, nil)
+	assert(err == nil, "%v", err)
+	via, err := transport.Proxy(req)
+	assert(err == nil, "finding the proxy: %v", err)
+	if via != nil {
+		slog.Info("Using a proxy", slog.String("proxy", via.Redacted()))
+	}
+	client := http.Client{Transport: transport}
 
 	hibp := &hibp{
-		prefixes: prefixes,
-		manual:   manual,
-		client:   http.Client{Timeout: time.Duration(30 * time.Second)},
-		bufs:     bufs,
-		tarBuf:   tarBuf,
+		chunks:  chunks,
+		workers: workers,
+		manual:  manual,
+
+		base:         strings.TrimSuffix(base, "/"),
+		userAgent:    userAgent,
+		mode:         mode,
+		padding:      padding,
+		validate:     validate,
+		client:       &client,
+		timeout:      requestTimeout,
+		retry:        retry,
+		retryBudget:  retryBudget,
+		maxThrottled: maxThrottled,
+		maxRange:     maxRangeBytes,
+
+		outPath:   outPath,
+		gzip:      gzipLevel,
+		hdr:       memberHeader(mtime, fileMode),
+		statePath: statePath,
+		restart:   restart,
+		resume:    resumeTar,
+
+		statsInterval: statsInterval,
+		metricsAddr:   metricsAddr,
+		reportPath:    reportPath,
+		gzipReport:    compressManifest,
+
+		direct:   direct,
+		stream:   stream,
+		pipeline: pipeline,
+		overlap:  overlap,
+
+		keepGoing: keepGoing,
+	}
+	// No request has been made yet, so every connection is counted, including
+	// those for the server's limits and the dataset's metadata.
+	transport.DialContext = countReads(transport.DialContext, &hibp.stats.wire)
+
+	// A dry run makes no requests, so it plans with the configured limits.
+	if limitsFromServer && !dryRun {
+		limitsClient := http.Client{Transport: transport.Clone(), Timeout: requestTimeout}
+		l, from, err := fetchLimits(&limitsClient, strings.TrimSuffix(base, "/"))
+		if err != nil {
+			slog.Warn("Proceeding with the configured limits as the server's couldn't be fetched", slog.String("error", err.Error()))
+		} else {
+			workers, rps = l.apply(workers, rps, from)
+			hibp.workers = workers
+		}
+	}
+	if maxIdle == 0 {
+		maxIdle = workers
+	}
+	transport.MaxIdleConns = maxIdle
+	transport.MaxIdleConnsPerHost = maxIdle
+	rangeCap, tarCap := 48_000, 160_000_000 // Loose upper bounds for a range and a tar.
+	// A dry run makes no requests, so it plans with the loose bounds.
+	if metaURL != "" && !dryRun {
+		metaClient := client
+		metaClient.Timeout = requestTimeout
+		m, err := fetchMeta(&metaClient, metaURL)
+		if err != nil {
+			slog.Warn("Proceeding without the dataset's metadata", slog.String("url", metaURL), slog.String("error", err.Error()))
+		} else {
+			slog.Info("Fetched the dataset's metadata", slog.String("version", m.Version), slog.Int("ranges", m.Ranges),
+				slog.Int64("entries", m.Entries), slog.Int("max_range_bytes", m.MaxRangeBytes))
+			// A larger range would be rejected anyway, so there's no sense in
+			// making room for it.
+			if int64(m.MaxRangeBytes) > maxRangeBytes {
+				slog.Warn("Clamping the metadata's maximum range size to -max-range-bytes", slog.Int("max_range_bytes", m.MaxRangeBytes),
+					slog.Int64("limit", maxRangeBytes))
+				m.MaxRangeBytes = int(maxRangeBytes)
+			}
+			if m.MaxRangeBytes > 0 {
+				rangeCap, tarCap = m.MaxRangeBytes, tarSize(m.MaxRangeBytes)
+			}
+			// The bound from the largest range is far too large for a tar of
+			// typical ranges (4GiB at a -max-range-bytes of 1MiB), whereas a tar
+			// buffer that's too small merely grows.
+			suffixLen := 35
+			if mode == "ntlm" {
+				suffixLen = 27
+			}
+			if est := m.tarEstimate(suffixLen); est > 0 {
+				tarCap = min(tarCap, est)
+			}
+			hibp.meta = &m
+		}
+	}
+
+	pool := newBufPool(rangeCap)
+	var bufs, spare []*bytes.Buffer
+	var tarBuf *bytes.Buffer
+	if overlap {
+		// The chunks are written straight from the buffers, so there's no tar
+		// buffer to hold.
+		bufs, spare = make([]*bytes.Buffer, 0x1000), make([]*bytes.Buffer, 0x1000)
+		for i := range bufs {
+			bufs[i], spare[i] = pool.get(), pool.get()
+		}
+	} else if pipeline == 0 && !direct && !stream {
+		bufs = make([]*bytes.Buffer, 0x1000)
+		for i := range bufs {
+			bufs[i] = pool.get()
+		}
+
+		bs := make([]byte, 0, tarCap)
+		tarBuf = bytes.NewBuffer(bs)
+	}
+	hibp.bufs, hibp.spare, hibp.tarBuf, hibp.pool = bufs, spare, tarBuf, pool
+
+	if rps > 0 || throttleLatency > 0 {
+		hibp.limiter = newLimiter(rps)
+	}
+	if throttleLatency > 0 {
+		hibp.throttle = newLatencyThrottle(hibp.limiter, throttleLatency, rps)
+	}
+	if connTrace {
+		hibp.conns = newConnStats()
+	}
+	if reportPath != "" {
+		hibp.stats.latency = new(latencyHistogram)
+	}
+	if bwPerSec > 0 {
+		hibp.bwLimiter = newLimiter(float64(bwPerSec))
+	}
+
+	if sampleN != 0 {
+		assert(sampleN > 0, "the number of hashes to sample must be positive")
+		assert(outPath != "", "-sample-verify requires -o")
+		mode, err := archiveMode(outPath)
+		assert(err == nil, "reading the mode of %q: %v", outPath, err)
+		assert(mode == hibp.mode, "%q holds %s hashes, not %s hashes (see -mode)", outPath, mode, hibp.mode)
+		checked, matched, err := hibp.sampleVerify(context.Background(), outPath, sampleN)
+		assert(err == nil, "verifying a sample of %q: %v", outPath, err)
+		slog.Info("Verified a sample against the live API", slog.Int("checked", checked), slog.Int("matched", matched),
+			slog.Float64("match_rate", float64(matched)/float64(max(checked, 1))))
+		if matched < checked {
+			exitCode = 1
+		}
+		return
+	}
+
+	// This comes before the other outputs are created, as creating them would
+	// truncate them.
+	if dryRun {
+		err := hibp.dryRun(tarCap, gzPath, textPath, outDirPath, tarDirPath, manifestPath, headersPath, etagsPath)
+		assert(err == nil, "planning the run: %v", err)
+		return
+	}
+
+	if gzPath != "" {
+		hibp.members = newMembers(gzPath)
+	}
+
+	if outDirPath != "" {
+		o, err := newOutDir(outDirPath, shard, skipExisting)
+		assert(err == nil, "creating %q: %v", outDirPath, err)
+		hibp.outDir = o
+	}
+	if tarDirPath != "" {
+		t, err := newTarDir(tarDirPath, hibp.hdr, gzipLevel)
+		assert(err == nil, "creating %q: %v", tarDirPath, err)
+		hibp.tarDir = t
+		if resumeTar && outPath == "" {
+			left, err := t.todo(hibp.chunks)
+			assert(err == nil, "checking %q: %v", tarDirPath, err)
+			slog.Info("Skipping the chunks already written", slog.String("dir", tarDirPath), slog.Int("chunks", len(hibp.chunks)-len(left)))
+			hibp.chunks = left
+		}
+	}
+
+	hibp.text = txt
+	if manifestPath != "" {
+		hibp.manifest = newManifest(manifestPath, compressManifest)
+	}
+
+	if etagsPath != "" {
+		e, err := newETags(etagsPath, prevPath)
+		assert(err == nil, "loading the ETags: %v", err)
+		hibp.etags = e
+	}
+
+	if headersPath != "" {
+		h, err := newHeaderDump(headersPath, headersRate)
+		assert(err == nil, "creating %q: %v", headersPath, err)
+		hibp.headers = h
+	}
+
+	// By default, the first SIGINT or SIGTERM cancels the run; as NotifyContext's
+	// stop restores the default behaviour, a second signal kills the process.
+	ctx := context.Background()
+	if drain {
+		hibp.drainOnSignal()
+	} else {
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			stop()
+		}()
+	}
+
+	err = hibp.run(ctx)
+	if rss, ok := peakRSS(); ok {
+		slog.Info("Peak memory usage", slog.Int64("rss_bytes", rss), slog.Bool("direct", direct), slog.Bool("stream", stream))
+	}
+	stoppedEarly := errors.Is(err, errDrained) || errors.Is(err, context.Canceled)
+	switch {
+	case stoppedEarly:
+		slog.Warn("Stopped early", slog.String("reason", err.Error()))
+		exitCode = 1
+	case err != nil && logFormat == "json":
+		// The orchestrator reading the logs can parse this, unlike a panic.
+		writeErrorJSON(os.Stderr, err)
+		exitCode = 1
+		return
+	default:
+		assert(err == nil, "failed to finish running: %v", err)
+	}
+	if n := hibp.failures.count(); n > 0 || failuresPath != "" {
+		slog.Info("Skipped ranges", slog.Int("count", n), slog.String("failures", failuresPath))
+		if failuresPath != "" {
+			err = hibp.failures.write(failuresPath)
+			assert(err == nil, "writing %q: %v", failuresPath, err)
+		}
+		if n > 0 {
+			exitCode = 1
+		}
+	}
+	if hibp.members != nil {
+		err = hibp.members.close()
+		assert(err == nil, "closing %q: %v", gzPath, err)
+	}
+	if hibp.text != nil {
+		err = hibp.text.close()
+		assert(err == nil, "closing %q: %v", textPath, err)
+	}
+	if hibp.headers != nil {
+		err = hibp.headers.close()
+		assert(err == nil, "closing %q: %v", headersPath, err)
+	}
+	if hibp.etags != nil {
+		slog.Info("Reused unchanged ranges", slog.Int64("ranges", hibp.etags.hits.Load()))
+		// The ETags are only saved with a complete tar (a run that failed outright
+		// has panicked by now), so that they can't be paired with bytes they
+		// didn't come with.
+		var size int64
+		complete := !stoppedEarly
+		if complete {
+			fi, err := os.Stat(outPath)
+			assert(err == nil, "finding the size of %q: %v", outPath, err)
+			size = fi.Size()
+		}
+		err = hibp.etags.close(complete, size)
+		assert(err == nil, "writing %q: %v", etagsPath, err)
+	}
+}
+
+// memberHeader returns the template for the tar's members. Only the name and
+// size vary between members; everything else (the owner, the group, and the
+// times included) is fixed, so that the same ranges written with the same
+// -mtime make the same tar, byte for byte.
+func memberHeader(mtime, fileMode string) tar.Header {
+	t := time.Now()
+	if mtime != "" {
+		var err error
+		t, err = time.Parse(time.RFC3339, mtime)
+		assert(err == nil, "parsing the modification time: %v", err)
+	}
+	// The USTAR format holds whole seconds since the epoch.
+	assert(t.Unix() >= 0, "the modification time can't be before 1970")
+	mode, err := strconv.ParseInt(fileMode, 8, 32)
+	assert(err == nil && mode&^0o7777 == 0, "the file mode must be in octal and in 0000..7777, not %q", fileMode)
+	return tar.Header{
+		Typeflag: tar.TypeReg,
+		Mode:     mode,
+		ModTime:  time.Unix(t.Unix(), 0),
+		Format:   tar.FormatUSTAR,
 	}
-	err := hibp.run()
-	assert(err == nil, "failed to finish running: %v", err)
 }
 
 func assert(b bool, msg string, args ...any) {
@@ -87,99 +764,539 @@ func assert(b bool, msg string, args ...any) {
 	}
 }
 
-func (d *hibp) run() error {
-	for i := 0; i < d.prefixes; i++ {
+// unescape interprets Go escape sequences (e.g., \t and \r\n) in s.
+func unescape(s string) (string, error) {
+	return strconv.Unquote(`"` + strings.ReplaceAll(s, `"`, `\"`) + `"`)
+}
+
+// parseBytes parses a byte count in the form accepted by GOMEMLIMIT: an integer
+// with an optional B, KiB, MiB, GiB, or TiB suffix.
+func parseBytes(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mult   int64
+	}{{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}, {"B", 1}}
+	mult := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSuffix(s, u.suffix), u.mult
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("%d is not positive", n)
+	}
+	return n * mult, nil
+}
+
+func (d *hibp) run(ctx context.Context) (err error) {
+	if d.statsInterval > 0 {
+		stop := d.stats.logStats(d.statsInterval)
+		defer stop()
+	}
+	began := time.Now()
+	defer func() {
+		r := d.stats.report(err == nil, time.Since(began))
+		r.Conns = d.conns.report()
+		r.Files = d.outDir.report()
+		if d.meta != nil {
+			r.DatasetVersion = d.meta.Version
+		}
+		if rerr := r.log(d.reportPath, d.gzipReport); rerr != nil && err == nil {
+			err = fmt.Errorf("writing the report: %w", rerr)
+		}
+	}()
+	if d.metricsAddr != "" {
+		stop, err := d.stats.serveMetrics(d.metricsAddr)
+		if err != nil {
+			return fmt.Errorf("serving metrics: %w", err)
+		}
+		defer stop()
+	}
+
+	start, resume, offset, err := d.startingPoint()
+	if err != nil {
+		return err
+	}
+
+	// These are appended to by a resumed run, as the tar is.
+	if d.members != nil {
+		if err := d.members.prepare(resume, start); err != nil {
+			return fmt.Errorf("opening %q: %w", d.members.path, err)
+		}
+	}
+	if d.text != nil {
+		if err := d.text.prepare(resume, start); err != nil {
+			return fmt.Errorf("opening %q: %w", d.text.path, err)
+		}
+	}
+	if d.outPath != "" {
+		if _, ok := socketAddr(d.outPath); !ok {
+			if err := writeMode(d.outPath, d.mode, resume); err != nil {
+				return err
+			}
+		}
+		if d.out, err = openOutput(d.outPath, d.gzip, resume, offset); err != nil {
+			return fmt.Errorf("opening the output: %w", err)
+		}
+		if d.manifest != nil {
+			if err := d.manifest.prepare(resume, start); err != nil {
+				return err
+			}
+			// The manifest is written however the run ends, so that a failed run
+			// can be resumed.
+			defer func() {
+				if cerr := d.manifest.close(); cerr != nil && err == nil {
+					err = fmt.Errorf("writing the manifest: %w", cerr)
+				}
+			}()
+		}
+		defer func() {
+			// The archive is only finished (with its trailer) if the run completed;
+			// otherwise, it's left as it was after the last completed chunk, ready
+			// to be appended to by a resumed run.
+			if err != nil {
+				if aerr := d.out.abort(); aerr != nil {
+					slog.Warn("Failed to discard the partial chunk", slog.String("output", d.outPath), slog.String("error", aerr.Error()))
+				}
+				return
+			}
+			if cerr := d.out.close(); cerr != nil && err == nil {
+				err = fmt.Errorf("closing the output: %w", cerr)
+			}
+		}()
+	}
+
+	prog := progress{start: time.Now(), total: d.meta.expected(len(d.chunksFrom(start)))}
+	if d.pipeline > 0 {
+		return d.runPipelined(ctx, start, &prog)
+	}
+	if d.overlap {
+		return d.runOverlapped(ctx, start, &prog)
+	}
+	for _, i := range d.chunksFrom(start) {
+		if d.draining.Load() {
+			return fmt.Errorf("%w before prefix %02x", errDrained, i)
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("interrupted before prefix %02x: %w", i, err)
+		}
+
 		chunkPrefix := fmt.Sprintf("%02x", i)
+		d.stats.prefix.Store(int64(i))
 		slog.Info("Fetching a hash chunk", slog.String("prefix", chunkPrefix))
-		if err := d.getChunk(i); err != nil {
+		getChunk := d.getChunk
+		if d.direct {
+			getChunk = d.getChunkDirect
+		} else if d.stream {
+			getChunk = d.getChunkStream
+		}
+		before := d.stats.bytes.Load()
+		if err := getChunk(ctx, i); err != nil {
 			return fmt.Errorf("getting chunk with prefix %s, %w", chunkPrefix, err)
 		}
 
+		var chunkBytes int64
 		for _, buf := range d.bufs {
+			chunkBytes += int64(buf.Len())
+		}
+		if d.bufs == nil { // There are no buffers to measure, so use what was read.
+			chunkBytes = d.stats.bytes.Load() - before
+		}
+		for i, buf := range d.bufs {
 			buf.Reset()
+			// A buffer that grew to fit an outlier is replaced, so that its memory
+			// can be collected.
+			if d.pool.oversized(buf) {
+				d.bufs[i] = d.pool.get()
+			}
 		}
-		d.tarBuf.Reset()
-		if d.manual {
-			runtime.GC()
+		if d.tarBuf != nil {
+			d.tarBuf.Reset()
+		}
+		if err := d.finishChunk(i, chunkBytes, &prog); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startingPoint returns the first chunk to fetch and, if the run resumes from
+// -state or under -resume, the size of the output to keep.
+func (d *hibp) startingPoint() (start int, resume bool, offset int64, err error) {
+	if d.restart {
+		return 0, false, 0, nil
+	}
+	if d.resume && d.outPath != "" {
+		c, ok, err := tarCheckpoint(d.outPath)
+		if err != nil || !ok {
+			return 0, false, 0, err
+		}
+		slog.Info("Resuming", slog.String("output", d.outPath), slog.String("prefix", fmt.Sprintf("%02x", c.prefix+1)), slog.Int64("offset", c.offset))
+		return c.prefix + 1, true, c.offset, nil
+	}
+	if d.statePath == "" {
+		return 0, false, 0, nil
+	}
+	c, ok, err := loadState(d.statePath)
+	if err != nil || !ok {
+		return 0, false, 0, err
+	}
+	slog.Info("Resuming", slog.String("state", d.statePath), slog.String("prefix", fmt.Sprintf("%02x", c.prefix+1)))
+	return c.prefix + 1, true, c.offset, nil
+}
+
+// chunksFrom returns the chunks to fetch from the given two-character prefix
+// onwards.
+func (d *hibp) chunksFrom(two int) []int {
+	i, _ := slices.BinarySearch(d.chunks, two)
+	return d.chunks[i:]
+}
+
+// rangeURL returns the URL of the range with the given five-character prefix.
+func (d *hibp) rangeURL(five int) string {
+	// The real API's responses are uppercase, as are the prefixes it documents.
+	u := fmt.Sprintf("%s/%05X", d.base, five)
+	if d.mode == "ntlm" {
+		u += "?mode=ntlm"
+	}
+	return u
+}
+
+// finishChunk records that the chunk with the given two-character prefix has
+// been written.
+func (d *hibp) finishChunk(two int, chunkBytes int64, prog *progress) error {
+	if d.statePath != "" {
+		c := checkpoint{prefix: two}
+		if d.out != nil {
+			c.offset = d.out.size()
+		}
+		if err := saveState(d.statePath, c); err != nil {
+			return fmt.Errorf("saving the state after prefix %02x: %w", two, err)
 		}
 	}
 
+	d.manifest.finish(two)
+	d.etags.finish(two)
+	prog.report(two, chunkBytes, len(d.chunksFrom(two+1)), d.stats.entries.Load())
+	if d.manual {
+		runtime.GC()
+	}
 	return nil
 }
 
-func (d *hibp) getChunk(two int) error {
-	var eg errgroup.Group
-	eg.SetLimit(workers)
-	for j := 0x000; j <= 0xfff; j++ {
+func (d *hibp) getChunk(ctx context.Context, two int) error {
+	if err := d.fetchChunk(ctx, two, d.bufs); err != nil {
+		return err
+	}
+	return d.writeChunk(two, d.bufs)
+}
+
+// writeChunk writes a chunk's ranges to the output and to any other outputs.
+func (d *hibp) writeChunk(two int, bufs []*bytes.Buffer) error {
+	if err := d.tar(two, bufs); err != nil {
+		return fmt.Errorf("writing the tar: %w", err)
+	}
+	if d.members != nil {
+		if err := d.members.write(two, bufs); err != nil {
+			return fmt.Errorf("writing gzip members: %w", err)
+		}
+	}
+	if d.text != nil {
+		if err := d.text.write(two, bufs); err != nil {
+			return fmt.Errorf("writing text: %w", err)
+		}
+	}
+	if d.outDir != nil {
+		if err := d.outDir.write(two, bufs); err != nil {
+			return fmt.Errorf("writing files: %w", err)
+		}
+	}
+	if d.tarDir != nil {
+		if err := d.tarDir.write(two, bufs); err != nil {
+			return fmt.Errorf("writing the chunk's tar: %w", err)
+		}
+	}
+	return nil
+}
+
+// fetchChunk fetches the ranges of the chunk with the given two-character
+// prefix into bufs, by three-character suffix.
+func (d *hibp) fetchChunk(ctx context.Context, two int, bufs []*bytes.Buffer) error {
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(d.workers)
+	for j := 0x000; j <= 0xfff && ctx.Err() == nil; j++ {
 		three := j
 		eg.Go(func() error {
 			five := two*0x1000 + three
-			if err := d.getOne(five, three); err != nil {
-				return fmt.Errorf("fetching hashes for prefix %02x: %w", five, err)
+			if err := d.getOne(ctx, five, bufs[three]); err != nil {
+				return &rangeError{five: five, err: err}
 			}
 			return nil
 		})
 	}
+	return eg.Wait()
+}
 
-	if err := eg.Wait(); err != nil {
-		return err
+// A rangeSink is what a range is fetched into: a buffer or, under -stream, a
+// spool file. Reset discards what's been written (e.g., by a failed attempt).
+type rangeSink interface {
+	io.Writer
+	Reset()
+}
+
+func (d *hibp) getOne(ctx context.Context, five int, buf rangeSink) (err error) {
+	d.stats.start()
+	defer d.stats.active.Add(-1)
+	ctx = d.conns.withTrace(ctx)
+
+	// Under -keep-going, a range that can't be fetched is recorded and left
+	// empty rather than failing its chunk.
+	defer func() {
+		if err != nil && d.keepGoing && ctx.Err() == nil {
+			d.failures.add(five, err)
+			d.etags.delete(five)
+			buf.Reset()
+			err = nil
+		}
+	}()
+
+	// The retries share a budget, so a misbehaving range can't hold up its chunk
+	// indefinitely. It starts from the first failure, so that an attempt that
+	// timed out can still be retried.
+	var deadline time.Time
+	attempt, throttled := 0, 0
+	for {
+		resp, err := d.fetch(ctx, five, buf)
+		if err == nil {
+			d.stats.ranges.Add(1)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if deadline.IsZero() {
+			deadline = time.Now().Add(d.retryBudget)
+		}
+
+		delay, ok := retryAfter(resp, time.Now())
+		if ok {
+			// This is the server asking us to slow down rather than a failure, so
+			// it isn't counted against the retry policy's attempts.
+			throttled++
+			d.stats.throttled.Add(1)
+			if throttled > d.maxThrottled {
+				return fmt.Errorf("giving up after being throttled %d times: %w", d.maxThrottled, err)
+			}
+			slog.Warn("Throttled", slog.String("prefix", fmt.Sprintf("%05x", five)), slog.Duration("retry_after", delay))
+			deadline = time.Now().Add(delay + d.retryBudget)
+		} else {
+			attempt++
+			if delay, ok = d.retry.NextDelay(attempt, resp); !ok {
+				return err
+			}
+			if after, ok := unavailableFor(resp, time.Now()); ok {
+				delay = max(delay, after)
+			}
+			if time.Now().Add(delay).After(deadline) {
+				return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+			}
+			d.stats.retries.Add(1)
+			// The URL is dropped from the error (the prefix is logged anyway) so
+			// that repeats of the same failure can be coalesced.
+			var uerr *url.Error
+			if errors.As(err, &uerr) {
+				err = uerr.Err
+			}
+			slog.Warn("Retrying a range", slog.String("prefix", fmt.Sprintf("%05x", five)), slog.Int("attempt", attempt),
+				slog.Duration("delay", delay), slog.String("error", err.Error()))
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
 	}
+}
 
-	if err := d.tar(two); err != nil {
-		return fmt.Errorf("handling tar file (prefix: %03x): %w", two, err)
+// fetch makes a single attempt at fetching a range into buf. If the attempt
+// fails, the response (if any) is returned for the retry policy; its body has
+// already been closed.
+func (d *hibp) fetch(ctx context.Context, five int, buf rangeSink) (*http.Response, error) {
+	resp, err := d.fetchOnce(ctx, five, buf, d.etags.cached(five))
+	if errors.Is(err, errUncached) {
+		slog.Warn("Fetching an unmodified range in full", slog.String("prefix", fmt.Sprintf("%05x", five)), slog.String("error", err.Error()))
+		return d.fetchOnce(ctx, five, buf, "")
 	}
-	return nil
+	return resp, err
 }
 
-func (d *hibp) getOne(five, three int) error {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/%05x", base, five), nil)
+// fetchOnce makes a single request for a range, conditional on the validator (an
+// ETag or a Last-Modified time) if it's set.
+func (d *hibp) fetchOnce(ctx context.Context, five int, buf rangeSink, validator string) (*http.Response, error) {
+	if d.limiter != nil {
+		if err := d.limiter.wait(ctx, 1); err != nil {
+			return nil, err
+		}
+	}
+
+	// The deadline is set after waiting on the limiter so that it only bounds the
+	// request itself.
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", d.rangeURL(five), nil)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	req.Header.Set("User-Agent", d.userAgent)
+	if d.padding {
+		req.Header.Set("Add-Padding", "true")
+	}
+	if isETag(validator) {
+		req.Header.Set("If-None-Match", validator)
+	} else if validator != "" {
+		req.Header.Set("If-Modified-Since", validator)
 	}
 
+	sent := time.Now()
 	resp, err := d.client.Do(req)
+	d.stats.latency.observe(time.Since(sent))
+	d.throttle.observe(time.Since(sent))
+	d.stats.requests.Add(1)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
+	d.checkClock(resp, time.Now())
 
+	if d.headers != nil {
+		if err := d.headers.record(five, resp); err != nil {
+			return nil, fmt.Errorf("recording headers: %w", err)
+		}
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		if validator == "" {
+			return resp, errUncached
+		}
+		if err := d.etags.copyPrevious(five, buf); err != nil {
+			buf.Reset()
+			return nil, err
+		}
+		// The bytes are the previous tar's, so they keep its validator.
+		d.etags.set(five, validator)
+		return nil, nil
+	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code (%d != 200)", resp.StatusCode)
+		return resp, &statusError{code: resp.StatusCode}
 	}
 
-	_, err = io.Copy(d.bufs[three], resp.Body)
-	return err
+	// A byte more than the limit is read so that a body over it can be told apart
+	// from one at it.
+	var body io.Reader = io.LimitReader(resp.Body, d.maxRange+1)
+	if d.bwLimiter != nil {
+		body = &throttledReader{ctx: ctx, r: body, l: d.bwLimiter}
+	}
+	lc := &lineChecker{w: buf}
+	if d.validate {
+		// A SHA-1 hash has 40 hexadecimal characters and an NTLM hash 32, of
+		// which the prefix accounts for five.
+		lc.hashLen = 35
+		if d.mode == "ntlm" {
+			lc.hashLen = 27
+		}
+	}
+	var n int64
+	if d.padding {
+		n, err = copyUnpadded(lc, body)
+	} else {
+		n, err = io.Copy(lc, body)
+	}
+	d.stats.bytes.Add(n)
+	d.pool.observe(int(n))
+	if err == nil && n > d.maxRange {
+		err = fmt.Errorf("the body is larger than the limit of %d bytes", d.maxRange)
+	}
+	if err == nil {
+		err = lc.close()
+	}
+	if err != nil {
+		buf.Reset() // Don't keep a partial body around for the next attempt.
+		return nil, err
+	}
+	d.stats.entries.Add(lc.lines)
+	d.etags.set(five, validatorOf(resp.Header))
+	return nil, nil
 }
 
-func (d *hibp) tar(two int) error {
-	// This isn't necessary, as we know a priori that 160MB will be enough, but...
-	cap := 0
-	for _, buf := range d.bufs {
-		cap += 512       // The header.
-		cap += buf.Len() // The body.
-	}
-	cap += 1024 // The two trailing 512-byte zero blocks.
-	if diff := cap - d.tarBuf.Cap(); diff > 0 {
-		d.tarBuf.Grow(diff)
+// tar writes a chunk's ranges to the output. If there's a tar buffer, the tar
+// is built in it and then copied to the output in one go.
+func (d *hibp) tar(two int, bufs []*bytes.Buffer) error {
+	w := d.sink()
+	if d.tarBuf != nil {
+		// This isn't necessary, as the buffer would grow anyway, but it grows
+		// once rather than repeatedly.
+		cap := 0
+		for _, buf := range bufs {
+			cap += 512       // The header.
+			cap += buf.Len() // The body.
+		}
+		if diff := cap - d.tarBuf.Cap(); diff > 0 {
+			d.tarBuf.Grow(diff)
+		}
+		w = d.tarBuf
 	}
 
-	tw := tar.NewWriter(d.tarBuf)
-	hdr := tar.Header{Mode: 0o600}
-	for three, buf := range d.bufs {
-		hdr.Name = fmt.Sprintf("%05x", two*0x1000+three)
-		hdr.Size = int64(buf.Len())
-		if err := tw.WriteHeader(&hdr); err != nil {
+	tw := tar.NewWriter(w)
+	for three, buf := range bufs {
+		if err := writeMember(tw, d.hdr, d.manifest, two*0x1000+three, int64(buf.Len()), bytes.NewReader(buf.Bytes())); err != nil {
 			return err
 		}
-		if _, err := tw.Write(buf.Bytes()); err != nil {
+	}
+	// The chunks are appended to a single archive, so the trailer is written once
+	// at the end of the run rather than here.
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if d.tarBuf != nil {
+		if _, err := io.Copy(d.sink(), d.tarBuf); err != nil {
 			return err
 		}
 	}
+	if d.out != nil {
+		return d.out.flush(two)
+	}
+	return nil
+}
 
-	if err := tw.Close(); err != nil {
+// writeMember writes the member of the range with the given five-character
+// prefix to tw, after the template hdr, with its size bytes read from body. If m
+// is set, the member's checksum is added to it.
+func writeMember(tw *tar.Writer, hdr tar.Header, m *manifest, five int, size int64, body io.Reader) error {
+	hdr.Name = fmt.Sprintf("%05x", five)
+	hdr.Size = size
+	if err := tw.WriteHeader(&hdr); err != nil {
 		return err
 	}
-
-	_, err := io.Copy(io.Discard, d.tarBuf)
-	return err
+	if m == nil {
+		_, err := io.Copy(tw, body)
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, h), body); err != nil {
+		return err
+	}
+	m.addSum(five, [sha256.Size]byte(h.Sum(nil)), size)
+	return nil
 }
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rangeBody is the body served for a range by rangeServer.
+func rangeBody(five int) string {
+	return fmt.Sprintf("%035X:%d\r\n", five, five+1)
+}
+
+// rangeServer serves every range with rangeBody, except that fail is asked
+// first for the status with which to respond to each attempt at a range (where
+// the attempt is 1 for the first); a status of zero means the range is served.
+// It returns the server and the attempts made at each range.
+func rangeServer(t *testing.T, fail func(five, attempt int) int) (*httptest.Server, func(five int) int) {
+	t.Helper()
+	var mu sync.Mutex
+	attempts := map[int]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		five, err := strconv.ParseInt(path.Base(r.URL.Path), 16, 32)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		attempts[int(five)]++
+		attempt := attempts[int(five)]
+		mu.Unlock()
+
+		if fail != nil {
+			if status := fail(int(five), attempt); status != 0 {
+				if status == http.StatusTooManyRequests {
+					w.Header().Set("Retry-After", "0")
+				}
+				w.WriteHeader(status)
+				return
+			}
+		}
+		io.WriteString(w, rangeBody(int(five)))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func(five int) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts[five]
+	}
+}
+
+// newTestHIBP returns a downloader of the given chunks from srv that writes its
+// tar (with a fixed modification time) to a temporary file.
+func newTestHIBP(t *testing.T, srv *httptest.Server, chunks ...int) *hibp {
+	t.Helper()
+	pool := newBufPool(4096)
+	bufs := make([]*bytes.Buffer, 0x1000)
+	for i := range bufs {
+		bufs[i] = pool.get()
+	}
+	return &hibp{
+		chunks:  chunks,
+		workers: 8,
+
+		base:         srv.URL + "/range",
+		userAgent:    "hibp-test",
+		mode:         "sha1",
+		client:       srv.Client(),
+		timeout:      5 * time.Second,
+		retry:        fixedRetry{delay: time.Millisecond, attempts: 2},
+		retryBudget:  time.Minute,
+		maxThrottled: 1,
+		maxRange:     1 << 20,
+
+		bufs:    bufs,
+		tarBuf:  new(bytes.Buffer),
+		outPath: filepath.Join(t.TempDir(), "hibp.tar"),
+		hdr:     memberHeader("2024-01-01T00:00:00Z", "0600"),
+		pool:    pool,
+	}
+}
+
+// readTar returns the members of the tar at path, by name.
+func readTar(t *testing.T, path string) map[string]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	members := map[string]string{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return members
+		}
+		if err != nil {
+			t.Fatalf("reading %q: %v", path, err)
+		}
+		bs, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("reading %s from %q: %v", hdr.Name, path, err)
+		}
+		members[hdr.Name] = string(bs)
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		fail     func(five, attempt int) int
+		wantErr  string      // A substring of the error, if one is expected.
+		attempts map[int]int // The attempts expected at some of the ranges.
+	}{
+		{
+			name:     "a chunk succeeds",
+			attempts: map[int]int{0x00000: 1, 0x00fff: 1},
+		},
+		{
+			name: "an error mid-chunk",
+			fail: func(five, _ int) int {
+				if five == 0x00800 {
+					return http.StatusNotFound
+				}
+				return 0
+			},
+			wantErr:  "00800",
+			attempts: map[int]int{0x00800: 1}, // A 404 isn't retried.
+		},
+		{
+			name: "a request is retried, then succeeds",
+			fail: func(five, attempt int) int {
+				if five == 0x00123 && attempt == 1 {
+					return http.StatusInternalServerError
+				}
+				return 0
+			},
+			attempts: map[int]int{0x00123: 2, 0x00124: 1},
+		},
+		{
+			name: "a 429 is waited out without using up the retries",
+			fail: func(five, attempt int) int {
+				switch {
+				case five == 0x00456 && attempt <= 2:
+					return http.StatusInternalServerError
+				case five == 0x00456 && attempt == 3:
+					return http.StatusTooManyRequests
+				}
+				return 0
+			},
+			attempts: map[int]int{0x00456: 4},
+		},
+		{
+			name: "a range is throttled too often",
+			fail: func(five, _ int) int {
+				if five == 0x00789 {
+					return http.StatusTooManyRequests
+				}
+				return 0
+			},
+			wantErr:  "throttled 1 times",
+			attempts: map[int]int{0x00789: 2}, // The -max-throttled of 1, then one more.
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, attempts := rangeServer(t, tt.fail)
+			d := newTestHIBP(t, srv, 0x00)
+			err := d.run(context.Background())
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one mentioning %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			for five, want := range tt.attempts {
+				if got := attempts(five); got != want {
+					t.Errorf("got %d attempts at %05x, want %d", got, five, want)
+				}
+			}
+			if tt.wantErr != "" {
+				return
+			}
+
+			members := readTar(t, d.outPath)
+			if len(members) != 0x1000 {
+				t.Fatalf("got %d members, want %d", len(members), 0x1000)
+			}
+			for five := 0x00000; five <= 0x00fff; five++ {
+				name := fmt.Sprintf("%05x", five)
+				if got, want := members[name], rangeBody(five); got != want {
+					t.Fatalf("got %q for %s, want %q", got, name, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReproducibleTar(t *testing.T) {
+	srv, _ := rangeServer(t, nil)
+	build := func(t *testing.T, configure func(d *hibp)) []byte {
+		t.Helper()
+		d := newTestHIBP(t, srv, 0x00, 0x01)
+		configure(d)
+		if err := d.run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		bs, err := os.ReadFile(d.outPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bs
+	}
+
+	// The ways of building the tar are configured as in main.
+	want := build(t, func(*hibp) {})
+	tests := []struct {
+		name      string
+		configure func(d *hibp)
+	}{
+		{"again", func(*hibp) {}},
+		{"direct", func(d *hibp) { d.direct, d.bufs, d.tarBuf = true, nil, nil }},
+		{"stream", func(d *hibp) { d.stream, d.bufs, d.tarBuf = true, nil, nil }},
+		{"pipeline", func(d *hibp) { d.pipeline, d.bufs, d.tarBuf = 2, nil, nil }},
+		{"overlap", func(d *hibp) {
+			d.overlap, d.tarBuf = true, nil
+			d.spare = make([]*bytes.Buffer, 0x1000)
+			for i := range d.spare {
+				d.spare[i] = d.pool.get()
+			}
+		}},
+	}
+	// A second later, a modification time taken from the clock would differ.
+	time.Sleep(time.Second)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := build(t, tt.configure); !bytes.Equal(got, want) {
+				t.Errorf("got a tar of %d bytes that differs from the first, of %d bytes", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestRunCancelledMidChunk(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(d *hibp)
+	}{
+		{"default", func(*hibp) {}},
+		{"direct", func(d *hibp) { d.direct, d.bufs, d.tarBuf = true, nil, nil }},
+		{"stream", func(d *hibp) { d.stream, d.bufs, d.tarBuf = true, nil, nil }},
+		{"pipeline", func(d *hibp) { d.pipeline, d.bufs, d.tarBuf = 2, nil, nil }},
+		{"overlap", func(d *hibp) {
+			d.overlap, d.tarBuf = true, nil
+			d.spare = make([]*bytes.Buffer, 0x1000)
+			for i := range d.spare {
+				d.spare[i] = d.pool.get()
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var d *hibp
+			// The run is interrupted (as by a SIGINT) halfway through chunk 01, once
+			// chunk 00 has been written; under -pipeline and -overlap, chunk 01 may
+			// be fetched while chunk 00 is written.
+			srv, _ := rangeServer(t, func(five, attempt int) int {
+				if five != 0x01800 || attempt != 1 {
+					return 0
+				}
+				for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+					if _, ok, _ := loadState(d.statePath); ok {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Error("chunk 00 wasn't written")
+						break
+					}
+				}
+				cancel()
+				return 0
+			})
+			d = newTestHIBP(t, srv, 0x00, 0x01)
+			d.statePath = filepath.Join(t.TempDir(), "state")
+			tt.configure(d)
+
+			err := d.run(ctx)
+			if err == nil || !errors.Is(err, context.Canceled) || !strings.Contains(err.Error(), "prefix 01") {
+				t.Fatalf("got error %v, want a cancellation naming prefix 01", err)
+			}
+			// Only chunk 00 was written.
+			c, ok, err := tarCheckpoint(d.outPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(d.outPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok || c.prefix != 0x00 || c.offset != fi.Size() {
+				t.Fatalf("got a checkpoint of %+v (%t) in a tar of %d bytes, want chunk 00 alone", c, ok, fi.Size())
+			}
+			if members := readTar(t, d.outPath); len(members) != 0x1000 {
+				t.Fatalf("got %d members, want %d", len(members), 0x1000)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// manifest records the SHA-256 and length of each range written to the tar,
+// with a line of "PREFIX  SHA256  LENGTH" per range, in the style of sha256sum.
+// Only the entries of the chunks in flight are held in memory: each chunk's are
+// written to a temporary file once it's completed, and the file is renamed into
+// place when the run stops, whether or not it succeeded. Under
+// -compress-manifest, the file is gzipped.
+type manifest struct {
+	path     string
+	compress bool
+	tmp      *atomicFile // Created by prepare.
+	bw       *bufio.Writer
+	zw       *gzip.Writer // Optional; see -compress-manifest.
+	w        io.Writer    // zw, if it's set, or bw.
+
+	mu      sync.Mutex
+	pending map[int]manifestEntry // By five-character prefix, for the chunks not yet completed.
+}
+
+type manifestEntry struct {
+	sum [sha256.Size]byte
+	n   int64
+}
+
+func newManifest(path string, compress bool) *manifest {
+	return &manifest{path: path, compress: compress, pending: make(map[int]manifestEntry)}
+}
+
+// prepare readies the manifest for a run starting from the given chunk. A new
+// run removes any existing manifest, so that a crash can't leave one that
+// doesn't describe the tar; a resumed run carries on from the entries before
+// start in the manifest left by the run it resumes.
+func (m *manifest) prepare(resume bool, start int) error {
+	var prev *os.File
+	if resume {
+		var err error
+		prev, err = os.Open(m.path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("the manifest %q is missing, so it can't be resumed (see -restart)", m.path)
+		}
+		if err != nil {
+			return err
+		}
+		defer prev.Close()
+	} else if err := os.Remove(m.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	tmp, err := createAtomic(m.path)
+	if err != nil {
+		return err
+	}
+	m.tmp, m.bw = tmp, bufio.NewWriter(tmp)
+	m.w = m.bw
+	if m.compress {
+		m.zw = gzip.NewWriter(m.bw)
+		m.w = m.zw
+	}
+	if prev == nil {
+		return nil
+	}
+	if err := m.copyFrom(prev, start); err != nil {
+		tmp.abort()
+		m.tmp = nil
+		return err
+	}
+	return nil
+}
+
+// copyFrom copies the entries before the given chunk from the manifest prev.
+// The entries are in ascending order, so they're copied up to the first of a
+// chunk that's to be fetched again. prev may be compressed or not, whether or
+// not m is.
+func (m *manifest) copyFrom(prev io.Reader, start int) error {
+	r, err := gunzipped(prev)
+	if err != nil {
+		return fmt.Errorf("%q: %w", m.path, err)
+	}
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		five, _, err := parseManifestLine(sc.Text())
+		if err != nil {
+			return fmt.Errorf("%q %w", m.path, err)
+		}
+		if five >= start*0x1000 {
+			break
+		}
+		fmt.Fprintln(m.w, sc.Text())
+	}
+	return sc.Err()
+}
+
+// addSum records the checksum and size of a range's body.
+func (m *manifest) addSum(five int, sum [sha256.Size]byte, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending[five] = manifestEntry{sum: sum, n: n}
+}
+
+// finish writes out the entries of the chunk with the given two-character
+// prefix, which has been completed. The chunks are completed in ascending
+// order, so the entries are too.
+func (m *manifest) finish(two int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for five := two * 0x1000; five < (two+1)*0x1000; five++ {
+		if e, ok := m.pending[five]; ok {
+			fmt.Fprintf(m.w, "%05x  %x  %d\n", five, e.sum, e.n)
+			delete(m.pending, five)
+		}
+	}
+}
+
+// close atomically replaces the manifest with the entries of the completed
+// chunks.
+func (m *manifest) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tmp == nil {
+		return nil
+	}
+	if m.zw != nil {
+		if err := m.zw.Close(); err != nil {
+			m.tmp.abort()
+			return err
+		}
+	}
+	if err := m.bw.Flush(); err != nil {
+		m.tmp.abort()
+		return err
+	}
+	return m.tmp.commit()
+}
+
+// readManifest reads the entries of the manifest at path, which may be gzipped.
+func readManifest(path string) (map[int]manifestEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := gunzipped(f)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", path, err)
+	}
+
+	entries := make(map[int]manifestEntry)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		five, e, err := parseManifestLine(sc.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%q %w", path, err)
+		}
+		entries[five] = e
+	}
+	return entries, sc.Err()
+}
+
+// parseManifestLine parses a line of a manifest.
+func parseManifestLine(line string) (int, manifestEntry, error) {
+	var five int
+	var sum []byte
+	var e manifestEntry
+	if _, err := fmt.Sscanf(line, "%05x  %x  %d", &five, &sum, &e.n); err != nil || len(sum) != sha256.Size {
+		return 0, manifestEntry{}, fmt.Errorf("has a malformed line: %q", line)
+	}
+	copy(e.sum[:], sum)
+	return five, e, nil
+}
+
+// verify checks the tar at path (which may be gzipped) against the manifest at
+// manifestPath, logging each range that's missing, unexpected, or different. It
+// returns the number of problems.
+func verify(path, manifestPath string) (int, error) {
+	want, err := readManifest(manifestPath)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r, err := decompress(f)
+	if err != nil {
+		return 0, err
+	}
+
+	problems := 0
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return problems, err
+		}
+
+		var five int
+		if _, err := fmt.Sscanf(hdr.Name, "%05x", &five); err != nil {
+			slog.Error("Unexpected member", slog.String("name", hdr.Name))
+			problems++
+			continue
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, tr)
+		if err != nil {
+			return problems, err
+		}
+
+		e, ok := want[five]
+		delete(want, five)
+		switch {
+		case !ok:
+			slog.Error("Range missing from the manifest", slog.String("prefix", hdr.Name))
+			problems++
+		case n != e.n || [sha256.Size]byte(h.Sum(nil)) != e.sum:
+			slog.Error("Range doesn't match the manifest", slog.String("prefix", hdr.Name), slog.Int64("bytes", n), slog.Int64("want_bytes", e.n))
+			problems++
+		}
+	}
+
+	for five := range want {
+		slog.Error("Range missing from the tar", slog.String("prefix", fmt.Sprintf("%05x", five)))
+		problems++
+	}
+	return problems, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"unicode/utf16"
+)
+
+// ntlmHash returns the NTLM hash of password: the MD4 digest of its UTF-16LE
+// encoding.
+func ntlmHash(password string) [16]byte {
+	units := utf16.Encode([]rune(password))
+	bs := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(bs[2*i:], u)
+	}
+	return md4Sum(bs)
+}
+
+// md4Sum returns the MD4 digest of data, per RFC 1320. MD4 is long broken, but
+// it's what NTLM hashes are made with, and the standard library doesn't have
+// it.
+func md4Sum(data []byte) [16]byte {
+	// The message is padded with a one bit, then zeros, to 56 bytes modulo 64,
+	// and then its length in bits.
+	n := len(data)
+	msg := make([]byte, (n+8)/64*64+64)
+	copy(msg, data)
+	msg[n] = 0x80
+	binary.LittleEndian.PutUint64(msg[len(msg)-8:], uint64(n)*8)
+
+	s := [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+	var x [16]uint32
+	for block := msg; len(block) > 0; block = block[64:] {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(block[4*i:])
+		}
+		a, b, c, d := s[0], s[1], s[2], s[3]
+
+		// Round 1.
+		for _, i := range [...]int{0, 4, 8, 12} {
+			a = bits.RotateLeft32(a+(b&c|^b&d)+x[i], 3)
+			d = bits.RotateLeft32(d+(a&b|^a&c)+x[i+1], 7)
+			c = bits.RotateLeft32(c+(d&a|^d&b)+x[i+2], 11)
+			b = bits.RotateLeft32(b+(c&d|^c&a)+x[i+3], 19)
+		}
+		// Round 2.
+		for _, i := range [...]int{0, 1, 2, 3} {
+			a = bits.RotateLeft32(a+(b&c|b&d|c&d)+x[i]+0x5a827999, 3)
+			d = bits.RotateLeft32(d+(a&b|a&c|b&c)+x[i+4]+0x5a827999, 5)
+			c = bits.RotateLeft32(c+(d&a|d&b|a&b)+x[i+8]+0x5a827999, 9)
+			b = bits.RotateLeft32(b+(c&d|c&a|d&a)+x[i+12]+0x5a827999, 13)
+		}
+		// Round 3.
+		for _, i := range [...]int{0, 2, 1, 3} {
+			a = bits.RotateLeft32(a+(b^c^d)+x[i]+0x6ed9eba1, 3)
+			d = bits.RotateLeft32(d+(a^b^c)+x[i+8]+0x6ed9eba1, 9)
+			c = bits.RotateLeft32(c+(d^a^b)+x[i+4]+0x6ed9eba1, 11)
+			b = bits.RotateLeft32(b+(c^d^a)+x[i+12]+0x6ed9eba1, 15)
+		}
+
+		s[0], s[1], s[2], s[3] = s[0]+a, s[1]+b, s[2]+c, s[3]+d
+	}
+
+	var sum [16]byte
+	for i, v := range s {
+		binary.LittleEndian.PutUint32(sum[4*i:], v)
+	}
+	return sum
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// members writes each range as its own gzip member, concatenated into a single
+// file. A sidecar index maps each five-character prefix to the offset and
+// length of its member, so that a single range can be decompressed without
+// reading the rest of the file.
+type members struct {
+	path string
+	f    *os.File // Opened by prepare.
+	bw   *bufio.Writer
+	w    *countingWriter
+	idx  *os.File
+	iw   *bufio.Writer
+	zw   *gzip.Writer
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func indexPath(path string) string { return path + ".idx" }
+
+func newMembers(path string) *members {
+	return &members{path: path}
+}
+
+// prepare opens the file and its index for a run starting from the given chunk.
+// A new run truncates them; a resumed run keeps the members of the chunks
+// before start, as the tar does, and appends to them.
+func (m *members) prepare(resume bool, start int) error {
+	var end, idxEnd int64 // The bytes of the file and of the index to keep.
+	if resume {
+		var err error
+		if end, idxEnd, err = m.kept(start); err != nil {
+			return err
+		}
+	}
+
+	f, err := openTruncated(m.path, end)
+	if err != nil {
+		return err
+	}
+	idx, err := openTruncated(indexPath(m.path), idxEnd)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	m.f, m.bw, m.idx, m.iw = f, bw, idx, bufio.NewWriter(idx)
+	m.w = &countingWriter{w: bw, n: end}
+	m.zw = gzip.NewWriter(m.w)
+	return nil
+}
+
+// kept returns the size of the members before the given chunk and of their
+// entries in the index. The entries are in ascending order, so they're read up
+// to the first of a chunk that's to be fetched again.
+func (m *members) kept(start int) (end, idxEnd int64, err error) {
+	idx, err := os.Open(indexPath(m.path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, 0, fmt.Errorf("the index %q is missing, so %q can't be resumed (see -restart)", indexPath(m.path), m.path)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer idx.Close()
+
+	sc := bufio.NewScanner(idx)
+	for sc.Scan() {
+		var five int
+		var off, n int64
+		if _, err := fmt.Sscanf(sc.Text(), "%05x %d %d", &five, &off, &n); err != nil {
+			return 0, 0, fmt.Errorf("malformed index line %q", sc.Text())
+		}
+		if five >= start*0x1000 {
+			break
+		}
+		end, idxEnd = off+n, idxEnd+int64(len(sc.Text()))+1
+	}
+	if err := sc.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	fi, err := os.Stat(m.path)
+	if err != nil {
+		return 0, 0, err
+	}
+	if fi.Size() < end {
+		return 0, 0, fmt.Errorf("%q is smaller (%d bytes) than its index says (%d bytes)", m.path, fi.Size(), end)
+	}
+	return end, idxEnd, nil
+}
+
+// openTruncated opens the file at path for writing after its first size bytes,
+// discarding the rest; it's created if it doesn't exist.
+func openTruncated(path string, size int64) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// write appends the ranges of a two-character prefix as gzip members. They're
+// flushed to the file, so that a run resumed after this chunk can keep them.
+func (m *members) write(two int, bufs []*bytes.Buffer) error {
+	for three, buf := range bufs {
+		off := m.w.n
+		m.zw.Reset(m.w)
+		if _, err := m.zw.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		if err := m.zw.Close(); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(m.iw, "%05x %d %d\n", two*0x1000+three, off, m.w.n-off); err != nil {
+			return err
+		}
+	}
+	if err := m.bw.Flush(); err != nil {
+		return err
+	}
+	return m.iw.Flush()
+}
+
+func (m *members) close() error {
+	if m.f == nil {
+		return nil
+	}
+	if err := m.bw.Flush(); err != nil {
+		return err
+	}
+	if err := m.iw.Flush(); err != nil {
+		return err
+	}
+	if err := m.idx.Close(); err != nil {
+		return err
+	}
+	return m.f.Close()
+}
+
+// readMember decompresses the range for prefix from the file at path into w.
+func readMember(path, prefix string, w io.Writer) error {
+	idx, err := os.Open(indexPath(path))
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+
+	var off, n int64 = -1, 0
+	sc := bufio.NewScanner(idx)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 3 {
+			return fmt.Errorf("malformed index line %q", sc.Text())
+		}
+		if fields[0] != strings.ToLower(prefix) {
+			continue
+		}
+		if off, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return err
+		}
+		if n, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+			return err
+		}
+		break
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if off < 0 {
+		return fmt.Errorf("prefix %q is not in the index", prefix)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(io.NewSectionReader(f, off, n))
+	if err != nil {
+		return err
+	}
+	zr.Multistream(false)
+	_, err = io.Copy(w, zr)
+	return err
+}
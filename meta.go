@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// meta is the aggregate metadata a mirror may expose about its dataset.
+type meta struct {
+	Ranges        int    `json:"ranges"`          // The number of ranges.
+	Entries       int64  `json:"entries"`         // The number of entries across all ranges.
+	Version       string `json:"version"`         // An opaque dataset version.
+	MaxRangeBytes int    `json:"max_range_bytes"` // The size of the largest range.
+}
+
+func fetchMeta(client *http.Client, url string) (meta, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return meta{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return meta{}, fmt.Errorf("unexpected status code (%d != 200)", resp.StatusCode)
+	}
+
+	var m meta
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return meta{}, fmt.Errorf("decoding the metadata: %w", err)
+	}
+	if m.MaxRangeBytes < 0 {
+		return meta{}, fmt.Errorf("the maximum range size (%d) is negative", m.MaxRangeBytes)
+	}
+	return m, nil
+}
+
+// tarSize is an upper bound on the size of a chunk's tar given an upper bound
+// on the size of each range.
+func tarSize(rangeBytes int) int {
+	padded := (rangeBytes + 511) / 512 * 512
+	return 0x1000*(512+padded) + 1024 // The headers, the bodies, and the two trailing zero blocks.
+}
+
+// expected returns the number of entries expected in the given number of
+// chunks, assuming that the entries are spread evenly across the ranges, or
+// zero if m is nil or doesn't say.
+func (m *meta) expected(chunks int) int64 {
+	if m == nil || m.Ranges <= 0 {
+		return 0
+	}
+	return m.Entries * int64(chunks) * 0x1000 / int64(m.Ranges)
+}
+
+// tarEstimate estimates the size of a chunk's tar from the number of entries,
+// with a quarter to spare, given the length of a hash's suffix; it's zero if m
+// doesn't say. Unlike tarSize, it doesn't assume that every range is as large
+// as the largest.
+func (m *meta) tarEstimate(suffixLen int) int {
+	perChunk := m.expected(1)
+	if perChunk == 0 {
+		return 0
+	}
+	// A line is the suffix, a colon, a count of up to seven digits, and CRLF;
+	// each member has a header and up to a block of padding.
+	est := int(perChunk)*(suffixLen+10) + 0x1000*(512+511) + 1024
+	return est + est/4
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// serveMetrics serves the stats at addr under /metrics, in Prometheus's text
+// format, until the returned function is called. The function shuts the server
+// down, waiting briefly for any scrape in progress.
+func (s *stats) serveMetrics(addr string) (stop func(), err error) {
+	// The listener is opened here so that a bad address fails the run at once.
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.writeMetrics(w)
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("The metrics server failed", slog.String("error", err.Error()))
+		}
+	}()
+	slog.Info("Serving metrics", slog.String("addr", ln.Addr().String()))
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+		<-done
+	}, nil
+}
+
+func (s *stats) writeMetrics(w http.ResponseWriter) {
+	metric := func(name, kind, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, v)
+	}
+	metric("hibp_ranges_total", "counter", "The ranges downloaded.", s.ranges.Load())
+	metric("hibp_bytes_total", "counter", "The bytes downloaded.", s.bytes.Load())
+	metric("hibp_requests_total", "counter", "The requests made.", s.requests.Load())
+	metric("hibp_retries_total", "counter", "The requests retried after a failure.", s.retries.Load())
+	metric("hibp_throttled_total", "counter", "The 429s whose Retry-After was waited out.", s.throttled.Load())
+	metric("hibp_active_workers", "gauge", "The workers with a request in progress.", s.active.Load())
+	metric("hibp_prefix", "gauge", "The two-character prefix of the chunk being fetched.", s.prefix.Load())
+}
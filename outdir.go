@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// outDir writes each range to its own file, named by its five-character prefix
+// as in the server's /range directory. With shard set, the files are split
+// into a subdirectory per two-character prefix, so that no directory holds
+// more than 4096 of the 1,048,576 files. With skipExisting set, a file that
+// already has the range's size is left alone, which makes a re-run into the same
+// directory nearly free when little has changed.
+type outDir struct {
+	dir          string
+	shard        bool
+	skipExisting bool
+
+	written, skipped atomic.Int64
+}
+
+// filesReport counts the files written by an outDir for the report.
+type filesReport struct {
+	Written int64 `json:"written"`
+	Skipped int64 `json:"skipped"`
+}
+
+func newOutDir(dir string, shard, skipExisting bool) (*outDir, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &outDir{dir: dir, shard: shard, skipExisting: skipExisting}, nil
+}
+
+// write writes the ranges of a two-character prefix. The directory of a shard
+// is created once, before its files.
+func (o *outDir) write(two int, bufs []*bytes.Buffer) error {
+	dir := o.dir
+	if o.shard {
+		dir = filepath.Join(o.dir, fmt.Sprintf("%02x", two))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	for three, buf := range bufs {
+		name := filepath.Join(dir, fmt.Sprintf("%05x", two*0x1000+three))
+		if o.skipExisting {
+			if fi, err := os.Stat(name); err == nil && fi.Mode().IsRegular() && fi.Size() == int64(buf.Len()) {
+				o.skipped.Add(1)
+				continue
+			}
+		}
+		if err := os.WriteFile(name, buf.Bytes(), 0o644); err != nil {
+			return err
+		}
+		o.written.Add(1)
+	}
+	return nil
+}
+
+// report returns the counts for the report, or nil if o is nil.
+func (o *outDir) report() *filesReport {
+	if o == nil {
+		return nil
+	}
+	return &filesReport{Written: o.written.Load(), Skipped: o.skipped.Load()}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+)
+
+// output is the archive on disk to which each chunk's tar entries are
+// appended. Each chunk is flushed once it has been written, so a crash leaves a
+// valid (if trailer-less) archive up to the last completed prefix; the two
+// trailing zero blocks are written once, when the output is closed.
+//
+// Under -gzip, each chunk is compressed as its own gzip member. Concatenated
+// members form a valid gzip stream, so this also holds of a partial output.
+//
+// The output may instead be a consumer listening on a Unix socket (with -o
+// unix:PATH), to which the archive is streamed.
+type output struct {
+	f  io.WriteCloser  // An *os.File or a *consumer.
+	fw *countingWriter // Counts the bytes in the file.
+	bw *bufio.Writer
+	zw *gzip.Writer    // Optional; see -gzip.
+	cw *countingWriter // Counts the compressed bytes under -gzip.
+	n  int64           // The bytes written since the last flush (before compression).
+
+	flushed int64 // The size of the file as of the last flush.
+}
+
+// openOutput opens the output at path. If level is nonzero, the output is
+// compressed with gzip at that level. If resume is true, an existing output is
+// truncated to offset (discarding anything after the last checkpoint) and
+// appended to; otherwise, it's truncated entirely. A path of the form unix:PATH
+// is dialed rather than opened, and can't be resumed.
+func openOutput(path string, level int, resume bool, offset int64) (*output, error) {
+	if addr, ok := socketAddr(path); ok {
+		if resume {
+			return nil, fmt.Errorf("the consumer at %q can't be resumed", addr)
+		}
+		conn, err := net.Dial("unix", addr)
+		if err != nil {
+			return nil, err
+		}
+		return newOutput(&consumer{Conn: conn, addr: addr}, 0, level)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resume {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	} else {
+		offset = 0
+	}
+	f, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	if resume {
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if fi.Size() < offset {
+			f.Close()
+			return nil, fmt.Errorf("%q is smaller (%d bytes) than the checkpoint's offset (%d bytes)", path, fi.Size(), offset)
+		}
+		if err := f.Truncate(offset); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return newOutput(f, offset, level)
+}
+
+// newOutput returns the output writing to f, which already holds offset bytes.
+func newOutput(f io.WriteCloser, offset int64, level int) (*output, error) {
+	fw := &countingWriter{w: f, n: offset}
+	o := &output{f: f, fw: fw, bw: bufio.NewWriter(fw), flushed: offset}
+	if level != 0 {
+		o.cw = &countingWriter{w: o.bw}
+		var err error
+		if o.zw, err = gzip.NewWriterLevel(o.cw, level); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// socketAddr returns the address of the Unix socket named by an -o of the form
+// unix:PATH.
+func socketAddr(path string) (string, bool) {
+	return strings.CutPrefix(path, "unix:")
+}
+
+// consumer is a connection to a consumer listening on a Unix socket. A consumer
+// that disconnects aborts the run, as a failed write to a file would.
+type consumer struct {
+	net.Conn
+	addr string
+}
+
+func (c *consumer) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		err = fmt.Errorf("the consumer at %q disconnected: %w", c.addr, err)
+	}
+	return n, err
+}
+func (o *output) Write(p []byte) (int, error) {
+	o.n += int64(len(p))
+	if o.zw != nil {
+		return o.zw.Write(p)
+	}
+	return o.bw.Write(p)
+}
+
+// flush marks the end of the chunk with the given two-character prefix.
+func (o *output) flush(two int) error {
+	if o.zw != nil {
+		if err := o.zw.Close(); err != nil {
+			return err
+		}
+		slog.Info("Compressed a chunk", slog.String("prefix", fmt.Sprintf("%02x", two)), slog.Int64("bytes_in", o.n),
+			slog.Int64("bytes_out", o.cw.n), slog.Float64("ratio", float64(o.n)/float64(max(o.cw.n, 1))))
+		o.cw.n = 0
+		o.zw.Reset(o.cw)
+	}
+	o.n = 0
+	if err := o.bw.Flush(); err != nil {
+		return err
+	}
+	o.flushed = o.fw.n
+	return nil
+}
+
+// size returns the number of bytes that have been flushed to the file.
+func (o *output) size() int64 { return o.fw.n }
+
+// close finishes the archive with its trailer.
+func (o *output) close() error {
+	if _, err := o.Write(make([]byte, 1024)); err != nil {
+		return err
+	}
+	if o.zw != nil {
+		if err := o.zw.Close(); err != nil {
+			return err
+		}
+	}
+	if err := o.bw.Flush(); err != nil {
+		return err
+	}
+	return o.f.Close()
+}
+
+// abort closes the output without finishing it. Whatever was written since the
+// last flush (part of a chunk, as under -direct) is discarded from a file, so
+// that it's left holding whole chunks, ready to be resumed.
+func (o *output) abort() error {
+	if f, ok := o.f.(*os.File); ok {
+		if err := f.Truncate(o.flushed); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return o.f.Close()
+}
+
+// writeMode records the mode (sha1 or ntlm) of the output at path in a file
+// alongside it. When resuming, the recorded mode must match, so that SHA-1 and
+// NTLM ranges aren't mixed in one archive.
+func writeMode(path, mode string, resume bool) error {
+	modePath := path + ".mode"
+	if resume {
+		bs, err := os.ReadFile(modePath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err == nil && strings.TrimSpace(string(bs)) != mode {
+			return fmt.Errorf("%q holds %s hashes, not %s hashes", path, strings.TrimSpace(string(bs)), mode)
+		}
+	}
+	return os.WriteFile(modePath, []byte(mode+"\n"), 0o644)
+}
+
+// sink returns the writer to which the chunks' tars are written; this is
+// io.Discard unless -o is set.
+func (d *hibp) sink() io.Writer {
+	if d.out == nil {
+		return io.Discard
+	}
+	return d.out
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// runOverlapped is the alternative to run's loop used under -overlap. There are
+// two sets of buffers, used by alternate chunks: while one chunk is written from
+// its set (which is then reset and, under -manual, collected), the next is
+// fetched into the other, so the workers aren't left idle while a chunk is
+// written. The price is a second set of buffers, though no tar buffer is needed.
+func (d *hibp) runOverlapped(ctx context.Context, start int, prog *progress) error {
+	sets := [2][]*bytes.Buffer{d.bufs, d.spare}
+
+	// A chunk's set is only fetched into again once the chunk has been written,
+	// as the chunk in between can't be written before it.
+	written := make(chan error, 1)
+	written <- nil
+	wait := func(err error) error {
+		if werr := <-written; werr != nil {
+			return werr
+		}
+		return err
+	}
+
+	for n, i := range d.chunksFrom(start) {
+		if d.draining.Load() {
+			return wait(fmt.Errorf("%w before prefix %02x", errDrained, i))
+		}
+		if err := ctx.Err(); err != nil {
+			return wait(fmt.Errorf("interrupted before prefix %02x: %w", i, err))
+		}
+
+		slog.Info("Fetching a hash chunk", slog.String("prefix", fmt.Sprintf("%02x", i)))
+		d.stats.prefix.Store(int64(i))
+		bufs := sets[n%2]
+		if err := d.fetchChunk(ctx, i, bufs); err != nil {
+			return wait(fmt.Errorf("getting chunk with prefix %02x, %w", i, err))
+		}
+		if err := wait(nil); err != nil {
+			return err
+		}
+		go func(two int) { written <- d.writeSet(two, bufs, prog) }(i)
+	}
+	return wait(nil)
+}
+
+// writeSet writes a chunk from a set of buffers and readies the set for reuse.
+func (d *hibp) writeSet(two int, bufs []*bytes.Buffer, prog *progress) error {
+	if err := d.writeChunk(two, bufs); err != nil {
+		return fmt.Errorf("writing the chunk with prefix %02x: %w", two, err)
+	}
+
+	var chunkBytes int64
+	for i, buf := range bufs {
+		chunkBytes += int64(buf.Len())
+		buf.Reset()
+		// As in run, a buffer that grew to fit an outlier is replaced.
+		if d.pool.oversized(buf) {
+			bufs[i] = d.pool.get()
+		}
+	}
+	return d.finishChunk(two, chunkBytes, prog)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// copyUnpadded copies a range body from r to w, dropping the padding entries
+// (those with a count of zero) that the API adds under "Add-Padding: true".
+// Every other line is copied byte-for-byte, including its line ending. It
+// returns the number of bytes read.
+func copyUnpadded(w io.Writer, r io.Reader) (int64, error) {
+	br := bufio.NewReader(r)
+	var n int64
+	long := false // Within a line longer than br's buffer, which can't be padding.
+	for {
+		line, err := br.ReadSlice('\n')
+		n += int64(len(line))
+		if long || !isPadding(line) {
+			if _, err := w.Write(line); err != nil {
+				return n, err
+			}
+		}
+
+		long = err == bufio.ErrBufferFull
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil && !long {
+			return n, err
+		}
+	}
+}
+
+// isPadding reports whether a line (e.g., "0018A45C4D1DEF81644B54AB7F969B88D65:0\r\n")
+// has a count of zero.
+func isPadding(line []byte) bool {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	return bytes.HasSuffix(line, []byte(":0"))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// chunk is a chunk being fetched under -pipeline.
+type chunk struct {
+	two  int
+	bufs []*bytes.Buffer // From the pool, by three-character suffix.
+	left atomic.Int32    // The ranges yet to arrive.
+}
+
+// runPipelined is the alternative to run's loop used under -pipeline. Rather
+// than waiting for each chunk to be written before fetching the next, a single
+// errgroup spans the requests of every chunk, so the workers are kept busy
+// while a chunk is written. Up to d.pipeline chunks are in flight at once (which
+// bounds the memory held); as each one completes, it's handed to a writer that
+// writes the chunks in ascending order, whatever the order in which they
+// complete.
+func (d *hibp) runPipelined(ctx context.Context, start int, prog *progress) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(d.workers)
+
+	// As at most d.pipeline chunks hold a slot in the window, the sends to ready
+	// never block.
+	window := make(chan struct{}, d.pipeline)
+	ready := make(chan *chunk, d.pipeline)
+	written := make(chan error, 1)
+	go func() {
+		err := d.writeInOrder(d.chunksFrom(start), ready, window, prog)
+		if err != nil {
+			cancel(err)
+		}
+		written <- err
+	}()
+
+	var err error
+	for _, i := range d.chunksFrom(start) {
+		if d.draining.Load() {
+			err = fmt.Errorf("%w before prefix %02x", errDrained, i)
+			break
+		}
+		select {
+		case window <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			err = fmt.Errorf("interrupted before prefix %02x: %w", i, ctx.Err())
+			break
+		}
+
+		slog.Info("Fetching a hash chunk", slog.String("prefix", fmt.Sprintf("%02x", i)))
+		d.stats.prefix.Store(int64(i))
+		c := &chunk{two: i, bufs: make([]*bytes.Buffer, 0x1000)}
+		c.left.Store(0x1000)
+		for j := 0x000; j <= 0xfff && ctx.Err() == nil; j++ {
+			three := j
+			eg.Go(func() error {
+				five := c.two*0x1000 + three
+				buf := d.pool.get()
+				if err := d.getOne(ctx, five, buf); err != nil {
+					return fmt.Errorf("getting chunk with prefix %02x, %w", c.two, &rangeError{five: five, err: err})
+				}
+				c.bufs[three] = buf
+				if c.left.Add(-1) == 0 {
+					ready <- c
+				}
+				return nil
+			})
+		}
+	}
+
+	egErr := eg.Wait()
+	close(ready)
+	if werr := <-written; werr != nil {
+		return werr
+	}
+	if egErr != nil {
+		return egErr
+	}
+	return err
+}
+
+// writeInOrder writes the chunks from ready in the order of todo, and frees a
+// slot in the window for each.
+func (d *hibp) writeInOrder(todo []int, ready <-chan *chunk, window <-chan struct{}, prog *progress) error {
+	held := map[int]*chunk{}
+	for c := range ready {
+		held[c.two] = c
+		for len(todo) > 0 && held[todo[0]] != nil {
+			c := held[todo[0]]
+			delete(held, c.two)
+			if err := d.writeChunk(c.two, c.bufs); err != nil {
+				return fmt.Errorf("writing the chunk with prefix %02x: %w", c.two, err)
+			}
+
+			var chunkBytes int64
+			for _, buf := range c.bufs {
+				chunkBytes += int64(buf.Len())
+				d.pool.put(buf)
+			}
+			if err := d.finishChunk(c.two, chunkBytes, prog); err != nil {
+				return err
+			}
+			<-window
+			todo = todo[1:]
+		}
+	}
+	return nil
+}
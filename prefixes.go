@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// parsePrefixes parses a list of two-character prefixes, such as
+// "00-0f,a3,ff", into a sorted set. An entry of the form @path reads the
+// prefixes from a file, one per line; a line may also be a five-character
+// prefix (as in a -failures file), which stands for its chunk.
+func parsePrefixes(s string) ([]int, error) {
+	var chunks []int
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if path, ok := strings.CutPrefix(entry, "@"); ok {
+			bs, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			for _, line := range strings.Fields(string(bs)) {
+				if len(line) == 5 {
+					line = line[:2]
+				}
+				two, err := parsePrefix(line)
+				if err != nil {
+					return nil, fmt.Errorf("%q: %w", path, err)
+				}
+				chunks = append(chunks, two)
+			}
+			continue
+		}
+
+		lo, hi, isRange := strings.Cut(entry, "-")
+		first, err := parsePrefix(lo)
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if isRange {
+			if last, err = parsePrefix(hi); err != nil {
+				return nil, err
+			}
+			if last < first {
+				return nil, fmt.Errorf("the range %q is backwards", entry)
+			}
+		}
+		for two := first; two <= last; two++ {
+			chunks = append(chunks, two)
+		}
+	}
+
+	slices.Sort(chunks)
+	return slices.Compact(chunks), nil
+}
+
+// parsePrefix parses a two-character prefix in 00..ff.
+func parsePrefix(s string) (int, error) {
+	two, err := strconv.ParseUint(s, 16, 8)
+	if err != nil || len(s) != 2 {
+		return 0, fmt.Errorf("%q isn't a two-character prefix (00..ff)", s)
+	}
+	return int(two), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// progress tracks the chunks completed by a run so as to report the throughput
+// and an estimate of the time remaining.
+type progress struct {
+	start time.Time
+	done  int   // The chunks completed by this run (which excludes any resumed from).
+	bytes int64 // The bytes downloaded by this run.
+	total int64 // The entries this run is expected to fetch, per -meta-url, or zero.
+}
+
+// report logs the progress after completing the chunk with the given
+// two-character prefix, with remaining chunks left to fetch and entries fetched
+// so far.
+func (p *progress) report(two int, chunkBytes int64, remaining int, entries int64) {
+	p.done++
+	p.bytes += chunkBytes
+
+	elapsed := time.Since(p.start)
+	rate := 0.0
+	if secs := elapsed.Seconds(); secs > 0 {
+		rate = float64(p.bytes) / 1e6 / secs
+	}
+	// Chunks are of similar sizes, so the time per chunk so far is a reasonable
+	// guide to the time for those remaining. As p.done is at least 1, this is
+	// well-defined from the first chunk.
+	eta := elapsed / time.Duration(p.done) * time.Duration(remaining)
+
+	attrs := []any{
+		slog.String("prefix", fmt.Sprintf("%02x", two)),
+		slog.Int64("chunk_bytes", chunkBytes),
+		slog.Int64("total_bytes", p.bytes),
+		slog.Duration("elapsed", elapsed.Round(time.Millisecond)),
+		slog.Float64("mb_per_sec", rate),
+		slog.Int("remaining", remaining),
+		slog.Duration("eta", eta.Round(time.Second)),
+		slog.Int64("entries", entries),
+	}
+	if p.total > 0 {
+		attrs = append(attrs, slog.Int64("expected_entries", p.total), slog.Float64("percent", 100*float64(entries)/float64(p.total)))
+	}
+	slog.Info("Finished a hash chunk", attrs...)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// report summarises a run. It's logged at the end of the run and, under
+// -report, written to a file as JSON.
+type report struct {
+	Version      string  `json:"version"` // Of this tool; see -version.
+	Completed    bool    `json:"completed"`
+	Ranges       int64   `json:"ranges"`
+	Bytes        int64   `json:"bytes"`
+	WireBytes    int64   `json:"wire_bytes"`
+	Requests     int64   `json:"requests"`
+	Retries      int64   `json:"retries"`
+	Throttled    int64   `json:"throttled"`
+	DurationSecs float64 `json:"duration_secs"`
+	PeakActive   int64   `json:"peak_active_workers"`
+
+	DatasetVersion string `json:"dataset_version,omitempty"` // Only under -meta-url.
+
+	// The latencies, up to the responses' headers, are only kept under -report.
+	// P95Latency is the upper bound of the bucket holding the 95th percentile.
+	MeanLatency    float64         `json:"mean_latency_secs,omitempty"`
+	P95Latency     float64         `json:"p95_latency_secs,omitempty"`
+	LatencyBuckets []latencyBucket `json:"latency_buckets,omitempty"`
+
+	Conns *connReport  `json:"connections,omitempty"` // Only under -conntrace.
+	Files *filesReport `json:"files,omitempty"`       // Only under -out-dir.
+}
+
+// latencyBounds are the upper bounds of the buckets of a latencyHistogram; a
+// last bucket holds whatever's slower.
+var latencyBounds = [...]time.Duration{
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+}
+
+// latencyHistogram counts the requests by how long they took. A nil
+// *latencyHistogram ignores them.
+type latencyHistogram struct {
+	counts [len(latencyBounds) + 1]atomic.Int64
+	sum    atomic.Int64 // In nanoseconds.
+	max    atomic.Int64 // In nanoseconds; it stands in for the last bucket's bound.
+}
+
+// latencyBucket is a bucket of the histogram in the report. As with
+// Prometheus, the counts are cumulative.
+type latencyBucket struct {
+	LESecs float64 `json:"le_secs"`
+	Count  int64   `json:"count"`
+}
+
+// observe records that a request took d.
+func (h *latencyHistogram) observe(d time.Duration) {
+	if h == nil {
+		return
+	}
+	i := 0
+	for i < len(latencyBounds) && d > latencyBounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+	for {
+		m := h.max.Load()
+		if int64(d) <= m || h.max.CompareAndSwap(m, int64(d)) {
+			return
+		}
+	}
+}
+
+// fill sets the latencies in r.
+func (h *latencyHistogram) fill(r *report) {
+	if h == nil {
+		return
+	}
+	var n int64
+	bounds := append(latencyBounds[:], max(time.Duration(h.max.Load()), latencyBounds[len(latencyBounds)-1]))
+	r.LatencyBuckets = make([]latencyBucket, 0, len(bounds))
+	for i, bound := range bounds {
+		n += h.counts[i].Load()
+		r.LatencyBuckets = append(r.LatencyBuckets, latencyBucket{LESecs: bound.Seconds(), Count: n})
+	}
+	if n == 0 {
+		return
+	}
+	r.MeanLatency = (time.Duration(h.sum.Load()) / time.Duration(n)).Seconds()
+	rank := (n*95 + 99) / 100
+	for _, b := range r.LatencyBuckets {
+		if b.Count >= rank {
+			r.P95Latency = b.LESecs
+			break
+		}
+	}
+}
+
+// report returns the report of a run that took elapsed.
+func (s *stats) report(completed bool, elapsed time.Duration) report {
+	r := report{
+		Version:      version,
+		Completed:    completed,
+		Ranges:       s.ranges.Load(),
+		Bytes:        s.bytes.Load(),
+		WireBytes:    s.wire.Load(),
+		Requests:     s.requests.Load(),
+		Retries:      s.retries.Load(),
+		Throttled:    s.throttled.Load(),
+		DurationSecs: elapsed.Seconds(),
+		PeakActive:   s.peakActive.Load(),
+	}
+	s.latency.fill(&r)
+	return r
+}
+
+// log logs the report and, if path is set, writes it there (gzipped, if
+// compress is set).
+func (r report) log(path string, compress bool) error {
+	slog.Info("Run report", slog.String("version", r.Version), slog.Bool("completed", r.Completed), slog.Int64("ranges", r.Ranges), slog.Int64("bytes", r.Bytes),
+		slog.Int64("wire_bytes", r.WireBytes), slog.Int64("requests", r.Requests), slog.Int64("retries", r.Retries), slog.Int64("throttled", r.Throttled),
+		slog.Float64("duration_secs", r.DurationSecs), slog.Int64("peak_active_workers", r.PeakActive), slog.String("dataset_version", r.DatasetVersion))
+	if r.LatencyBuckets != nil {
+		slog.Info("Latency", slog.Float64("mean_secs", r.MeanLatency), slog.Float64("p95_secs", r.P95Latency))
+	}
+	if r.Conns != nil {
+		slog.Info("Connections", slog.Int64("reused", r.Conns.Reused), slog.Int64("fresh", r.Conns.Fresh),
+			slog.Int64("dns_lookups", r.Conns.DNSLookups), slog.Int64("tls_handshakes", r.Conns.TLSHandshakes))
+	}
+	if t := r.Conns.tls(); t != nil {
+		slog.Info("TLS", slog.String("version", t.Version), slog.String("cipher_suite", t.CipherSuite), slog.Time("leaf_expiry", t.LeafExpiry))
+		// A mirror whose certificate lapses fails every request of the next run.
+		if left := time.Until(t.LeafExpiry); left < certExpiryWarning {
+			slog.Warn("The server's certificate expires soon", slog.Time("leaf_expiry", t.LeafExpiry), slog.Duration("left", left.Round(time.Hour)))
+		}
+	}
+	if r.Files != nil {
+		slog.Info("Files", slog.Int64("written", r.Files.Written), slog.Int64("skipped", r.Files.Skipped))
+	}
+	if path == "" {
+		return nil
+	}
+
+	bs, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	bs = append(bs, '\n')
+	if compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(bs)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		bs = buf.Bytes()
+	}
+	return os.WriteFile(path, bs, 0o644)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// tarCheckpoint derives a checkpoint from the tar at path itself, as under
+// -resume: the last chunk all of whose 0x1000 members were written in full, in
+// order, and the offset just after it. The members are walked from the start,
+// and the walk stops at the first that's corrupt (tar checks each header's
+// checksum), misnamed, or truncated, so anything after the last complete chunk
+// is discarded on resuming. It returns false if there's no such chunk.
+func tarCheckpoint(path string) (checkpoint, bool, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return checkpoint{}, false, nil
+	}
+	if err != nil {
+		return checkpoint{}, false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return checkpoint{}, false, err
+	}
+
+	var c checkpoint
+	ok := false
+	two, three := -1, 0x1000 // The chunk being walked and its next member.
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, tar.ErrHeader) {
+			return c, ok, nil
+		}
+		if err != nil {
+			return checkpoint{}, false, err
+		}
+
+		// A chunk's members are written in ascending order and the chunks
+		// themselves follow in ascending order.
+		if three == 0x1000 {
+			var next int
+			if _, err := fmt.Sscanf(hdr.Name, "%02x000", &next); err != nil || next <= two {
+				return c, ok, nil
+			}
+			two, three = next, 0
+		}
+		if hdr.Name != fmt.Sprintf("%05x", two*0x1000+three) {
+			return c, ok, nil
+		}
+
+		// tar.Reader reads f directly, so f is now positioned at the member's
+		// data, which is padded to a whole block.
+		off, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return checkpoint{}, false, err
+		}
+		end := off + (hdr.Size+511)/512*512
+		if end > fi.Size() {
+			return c, ok, nil
+		}
+		three++
+		if three == 0x1000 {
+			c, ok = checkpoint{prefix: two, offset: end}, true
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResumeFromTruncatedTar(t *testing.T) {
+	srv, _ := rangeServer(t, nil)
+	full := newTestHIBP(t, srv, 0x00, 0x01)
+	if err := full.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(full.outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each member is a header block followed by its body, padded to a block.
+	var chunkEnds [2]int64
+	var end int64
+	for five := 0x00000; five <= 0x01fff; five++ {
+		end += 512 + (int64(len(rangeBody(five)))+511)/512*512
+		if five&0xfff == 0xfff {
+			chunkEnds[five>>12] = end
+		}
+	}
+
+	r := rand.New(rand.NewSource(1))
+	offsets := []int64{0, 511, chunkEnds[0] - 1, chunkEnds[0], chunkEnds[0] + 100, chunkEnds[1], int64(len(want))}
+	for i := 0; i < 5; i++ {
+		offsets = append(offsets, r.Int63n(int64(len(want))))
+	}
+
+	for _, offset := range offsets {
+		path := filepath.Join(t.TempDir(), "hibp.tar")
+		if err := os.WriteFile(path, want[:offset], 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		// The last complete chunk is the one whose end is the last at or before
+		// the offset.
+		wantOK, wantCheckpoint := false, checkpoint{}
+		for two, end := range chunkEnds {
+			if end <= offset {
+				wantOK, wantCheckpoint = true, checkpoint{prefix: two, offset: end}
+			}
+		}
+		c, ok, err := tarCheckpoint(path)
+		if err != nil {
+			t.Fatalf("truncated at %d: %v", offset, err)
+		}
+		if ok != wantOK || c != wantCheckpoint {
+			t.Fatalf("truncated at %d: got %+v (%t), want %+v (%t)", offset, c, ok, wantCheckpoint, wantOK)
+		}
+
+		d := newTestHIBP(t, srv, 0x00, 0x01)
+		d.outPath, d.resume = path, true
+		if err := d.run(context.Background()); err != nil {
+			t.Fatalf("resuming after truncating at %d: %v", offset, err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("resuming after truncating at %d: got a tar of %d bytes that differs from the original, of %d bytes", offset, len(got), len(want))
+		}
+	}
+}
+
+func TestResumeSideOutputs(t *testing.T) {
+	srv, _ := rangeServer(t, nil)
+	dir := t.TempDir()
+	build := func(name string, chunks ...int) {
+		t.Helper()
+		d := newTestHIBP(t, srv, chunks...)
+		d.outPath, d.statePath = filepath.Join(dir, name+".tar"), filepath.Join(dir, name+".state")
+		d.members = newMembers(filepath.Join(dir, name+".gz"))
+		text, err := newText(filepath.Join(dir, name+".txt"), ":", "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.text = text
+		if err := d.run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.members.close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.text.close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second run resumes from the -state left by the first.
+	build("resumed", 0x00)
+	build("resumed", 0x00, 0x01)
+	build("fresh", 0x00, 0x01)
+	for _, ext := range []string{".gz", ".gz.idx", ".txt"} {
+		got, err := os.ReadFile(filepath.Join(dir, "resumed"+ext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := os.ReadFile(filepath.Join(dir, "fresh"+ext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("got a resumed %s of %d bytes that differs from a fresh one, of %d bytes", ext, len(got), len(want))
+		}
+	}
+}
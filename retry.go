@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A RetryPolicy decides whether a failed request should be retried and, if so,
+// how long to wait first. The attempt is 1 for the first failure; resp is nil
+// if the request failed without a response (e.g., a network error).
+type RetryPolicy interface {
+	NextDelay(attempt int, resp *http.Response) (time.Duration, bool)
+}
+
+const (
+	retryBase = 500 * time.Millisecond
+	retryCap  = 10 * time.Second
+)
+
+// newRetryPolicy returns the named policy, which retries a request at most
+// attempts times.
+func newRetryPolicy(name string, attempts int) (RetryPolicy, error) {
+	if attempts < 0 {
+		return nil, fmt.Errorf("the number of retries (%d) is negative", attempts)
+	}
+
+	switch name {
+	case "none":
+		return noRetry{}, nil
+	case "fixed":
+		return fixedRetry{delay: retryBase, attempts: attempts}, nil
+	case "exponential":
+		return exponentialRetry{base: retryBase, cap: retryCap, attempts: attempts}, nil
+	case "jitter":
+		return jitterRetry{base: retryBase, cap: retryCap, attempts: attempts}, nil
+	default:
+		return nil, fmt.Errorf("unknown retry policy %q (want none, fixed, exponential, or jitter)", name)
+	}
+}
+
+// retryable reports whether a failure is worth retrying: network errors, 5xx
+// responses, and 429s are; anything else (e.g., a 404) is not.
+func retryable(resp *http.Response) bool {
+	return resp == nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+type noRetry struct{}
+
+func (noRetry) NextDelay(int, *http.Response) (time.Duration, bool) { return 0, false }
+
+type fixedRetry struct {
+	delay    time.Duration
+	attempts int
+}
+
+func (p fixedRetry) NextDelay(attempt int, resp *http.Response) (time.Duration, bool) {
+	if attempt > p.attempts || !retryable(resp) {
+		return 0, false
+	}
+	return p.delay, true
+}
+
+// exponentialRetry doubles the delay on each attempt, up to the cap. The delay
+// is jittered into [d/2, d] so that workers that failed together don't retry
+// together.
+type exponentialRetry struct {
+	base, cap time.Duration
+	attempts  int
+}
+
+func (p exponentialRetry) NextDelay(attempt int, resp *http.Response) (time.Duration, bool) {
+	if attempt > p.attempts || !retryable(resp) {
+		return 0, false
+	}
+	d := p.cap
+	if attempt < 32 && p.base<<(attempt-1) < p.cap {
+		d = p.base << (attempt - 1)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1)), true
+}
+
+// jitterRetry approximates "decorrelated jitter": each delay is drawn uniformly
+// from [base, upper], where upper grows as base*3^(attempt-1) up to the cap. The
+// policy is shared by every worker, so the bound is derived from the attempt
+// rather than from a stored previous delay.
+type jitterRetry struct {
+	base, cap time.Duration
+	attempts  int
+}
+
+func (p jitterRetry) NextDelay(attempt int, resp *http.Response) (time.Duration, bool) {
+	if attempt > p.attempts || !retryable(resp) {
+		return 0, false
+	}
+	upper := p.base
+	for i := 1; i < attempt && upper < p.cap; i++ {
+		upper *= 3
+	}
+	upper = min(p.cap, upper)
+	return p.base + time.Duration(rand.Int63n(int64(upper-p.base)+1)), true
+}
+
+// retryAfter returns how long a 429 response asks us to wait before retrying.
+// The Retry-After header may be a number of seconds or an HTTP date. It returns
+// false if the response isn't a 429 or has no usable header.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	return parseRetryAfter(resp.Header.Get("Retry-After"), now)
+}
+
+// unavailableFor returns how long a 503 response asks us to wait, as with
+// retryAfter. Unlike a 429, a 503 is a failure, so the wait only lengthens the
+// retry policy's delay.
+func unavailableFor(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	return parseRetryAfter(resp.Header.Get("Retry-After"), now)
+}
+
+func parseRetryAfter(h string, now time.Time) (time.Duration, bool) {
+	if secs, err := strconv.Atoi(h); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		return max(0, t.Sub(now)), true
+	}
+	return 0, false
+}
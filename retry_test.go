@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicies(t *testing.T) {
+	status := func(code int) *http.Response { return &http.Response{StatusCode: code} }
+	const base, ceiling = 100 * time.Millisecond, time.Second
+
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		attempt  int
+		resp     *http.Response
+		wantOK   bool
+		min, max time.Duration // The bounds of the delay, if it's retried.
+	}{
+		{name: "none never retries", policy: noRetry{}, attempt: 1, resp: status(500)},
+
+		{name: "fixed retries a 500", policy: fixedRetry{delay: base, attempts: 2}, attempt: 1, resp: status(500), wantOK: true, min: base, max: base},
+		{name: "fixed retries a network error", policy: fixedRetry{delay: base, attempts: 2}, attempt: 2, wantOK: true, min: base, max: base},
+		{name: "fixed gives up after its attempts", policy: fixedRetry{delay: base, attempts: 2}, attempt: 3, resp: status(500)},
+		{name: "fixed doesn't retry a 404", policy: fixedRetry{delay: base, attempts: 2}, attempt: 1, resp: status(404)},
+
+		{name: "exponential starts at the base", policy: exponentialRetry{base: base, cap: ceiling, attempts: 5}, attempt: 1, resp: status(503), wantOK: true, min: base / 2, max: base},
+		{name: "exponential doubles", policy: exponentialRetry{base: base, cap: ceiling, attempts: 5}, attempt: 3, resp: status(429), wantOK: true, min: 2 * base, max: 4 * base},
+		{name: "exponential is capped", policy: exponentialRetry{base: base, cap: ceiling, attempts: 50}, attempt: 40, wantOK: true, min: ceiling / 2, max: ceiling},
+		{name: "exponential gives up after its attempts", policy: exponentialRetry{base: base, cap: ceiling, attempts: 5}, attempt: 6, resp: status(500)},
+		{name: "exponential doesn't retry a 400", policy: exponentialRetry{base: base, cap: ceiling, attempts: 5}, attempt: 1, resp: status(400)},
+
+		{name: "jitter starts at the base", policy: jitterRetry{base: base, cap: ceiling, attempts: 5}, attempt: 1, resp: status(502), wantOK: true, min: base, max: base},
+		{name: "jitter grows threefold", policy: jitterRetry{base: base, cap: ceiling, attempts: 5}, attempt: 3, wantOK: true, min: base, max: 9 * base},
+		{name: "jitter is capped", policy: jitterRetry{base: base, cap: ceiling, attempts: 50}, attempt: 40, resp: status(500), wantOK: true, min: base, max: ceiling},
+		{name: "jitter gives up after its attempts", policy: jitterRetry{base: base, cap: ceiling, attempts: 5}, attempt: 6},
+		{name: "jitter doesn't retry a 404", policy: jitterRetry{base: base, cap: ceiling, attempts: 5}, attempt: 1, resp: status(404)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The delays are random, so each policy is asked several times.
+			for i := 0; i < 100; i++ {
+				delay, ok := tt.policy.NextDelay(tt.attempt, tt.resp)
+				if ok != tt.wantOK {
+					t.Fatalf("got ok = %t, want %t", ok, tt.wantOK)
+				}
+				if ok && (delay < tt.min || delay > tt.max) {
+					t.Fatalf("got a delay of %v, want one in [%v, %v]", delay, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestNewRetryPolicy(t *testing.T) {
+	for _, name := range []string{"none", "fixed", "exponential", "jitter"} {
+		if _, err := newRetryPolicy(name, 3); err != nil {
+			t.Errorf("newRetryPolicy(%q, 3): %v", name, err)
+		}
+	}
+	if _, err := newRetryPolicy("linear", 3); err == nil {
+		t.Error("newRetryPolicy accepted an unknown policy")
+	}
+	if _, err := newRetryPolicy("fixed", -1); err == nil {
+		t.Error("newRetryPolicy accepted a negative number of retries")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		h      string
+		want   time.Duration
+		wantOK bool
+	}{
+		{h: "0", want: 0, wantOK: true},
+		{h: "120", want: 2 * time.Minute, wantOK: true},
+		{h: "Mon, 01 Jan 2024 12:00:30 GMT", want: 30 * time.Second, wantOK: true},
+		{h: "Mon, 01 Jan 2024 11:59:00 GMT", want: 0, wantOK: true}, // A date in the past means now.
+		{h: "Monday, 01-Jan-24 12:01:00 GMT", want: time.Minute, wantOK: true},
+		{h: ""},
+		{h: "-5"},
+		{h: "1.5"},
+		{h: "soon"},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.h, now)
+		if ok != tt.wantOK || got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, %t; want %v, %t", tt.h, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
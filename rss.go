@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// peakRSS returns the process's peak resident set size in bytes. It's only
+// available on Linux, where it's read from /proc; elsewhere, it returns false.
+func peakRSS() (int64, bool) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// The line looks like "VmHWM:	  289372 kB".
+		kb, ok := strings.CutPrefix(sc.Text(), "VmHWM:")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(kb, "kB")), 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return n * 1024, true
+	}
+	return 0, false
+}
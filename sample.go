@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// sample is a hash picked from a local tar, with its count there.
+type sample struct {
+	five   int
+	suffix string
+	count  int
+}
+
+// pickSamples picks n hashes at random from the tar at path (which may be
+// gzipped): it picks n members by reservoir sampling, in a single pass that
+// only reads the bodies of the members it keeps, and then a line from each.
+func pickSamples(path string, n int) ([]sample, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := decompress(f)
+	if err != nil {
+		return nil, err
+	}
+
+	type member struct {
+		name string
+		body []byte
+	}
+	kept := make([]member, 0, n)
+	tr := tar.NewReader(r)
+	for seen := 0; ; seen++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		i := len(kept)
+		if i == n {
+			if i = rand.Intn(seen + 1); i >= n {
+				continue
+			}
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if i == len(kept) {
+			kept = append(kept, member{})
+		}
+		kept[i] = member{name: hdr.Name, body: body}
+	}
+
+	samples := make([]sample, 0, len(kept))
+	for _, m := range kept {
+		five, err := strconv.ParseInt(m.name, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("member %q isn't named by a prefix", m.name)
+		}
+		lines := strings.Fields(string(m.body))
+		if len(lines) == 0 {
+			continue // An empty range, as left by -keep-going, has nothing to check.
+		}
+		suffix, count, ok := strings.Cut(lines[rand.Intn(len(lines))], ":")
+		c, err := strconv.Atoi(count)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("member %s has a malformed line", m.name)
+		}
+		samples = append(samples, sample{five: int(five), suffix: strings.ToUpper(suffix), count: c})
+	}
+	return samples, nil
+}
+
+// sampleVerify checks n hashes, picked at random from the tar at path, against
+// the live API, under -sample-verify: each must be in its live range with the
+// same count. This catches the corruption or staleness that a structural check
+// of the tar can't, for a request per hash. It returns the number of hashes
+// checked and the number that matched.
+func (d *hibp) sampleVerify(ctx context.Context, path string, n int) (checked, matched int, err error) {
+	samples, err := pickSamples(path, n)
+	if err != nil {
+		return 0, 0, fmt.Errorf("sampling %q: %w", path, err)
+	}
+	var buf bytes.Buffer
+	for _, s := range samples {
+		buf.Reset()
+		if err := d.getOne(ctx, s.five, &buf); err != nil {
+			return checked, matched, &rangeError{five: s.five, err: err}
+		}
+		live, err := scanRange(&buf, s.suffix)
+		if err != nil {
+			return checked, matched, &rangeError{five: s.five, err: err}
+		}
+		checked++
+		if live != s.count {
+			slog.Warn("A sampled hash differs from the live API", slog.String("hash", fmt.Sprintf("%05X%s", s.five, s.suffix)),
+				slog.Int("count", s.count), slog.Int("live_count", live))
+			continue
+		}
+		matched++
+	}
+	return checked, matched, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSampleVerify(t *testing.T) {
+	srv, _ := rangeServer(t, nil)
+	d := newTestHIBP(t, srv, 0x00)
+	if err := d.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checked, matched, err := d.sampleVerify(context.Background(), d.outPath, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 10 || matched != 10 {
+		t.Fatalf("got %d of %d matching, want 10 of 10", matched, checked)
+	}
+
+	// A stale count is caught.
+	stale := filepath.Join(t.TempDir(), "stale.tar")
+	f, err := os.Create(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	body := fmt.Sprintf("%035X:%d\r\n", 0x00001, 99)
+	if err := tw.WriteHeader(&tar.Header{Name: "00001", Mode: 0o644, Size: int64(len(body))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checked, matched, err = d.sampleVerify(context.Background(), stale, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 1 || matched != 0 {
+		t.Fatalf("got %d of %d matching, want 0 of 1", matched, checked)
+	}
+}
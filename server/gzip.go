@@ -0,0 +1,59 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// acceptsGzip reports whether the request advertises gzip in Accept-Encoding.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc, _, _ = strings.Cut(enc, ";")
+		if strings.TrimSpace(enc) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipWriter compresses a successful response on the fly. Any other response
+// (e.g., a 304 or a 404) is passed through as it is.
+type gzipWriter struct {
+	http.ResponseWriter
+	zw      *gzip.Writer // Set once a 200 has been written.
+	written bool
+}
+
+func (g *gzipWriter) WriteHeader(status int) {
+	if g.written {
+		return
+	}
+	g.written = true
+	if status == http.StatusOK {
+		h := g.Header()
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length") // That of the uncompressed file.
+		h.Del("Accept-Ranges")
+		g.zw = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	if !g.written {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.zw != nil {
+		return g.zw.Write(p)
+	}
+	return g.ResponseWriter.Write(p)
+}
+
+// close finishes the compressed body, if there is one.
+func (g *gzipWriter) close() error {
+	if g.zw == nil {
+		return nil
+	}
+	return g.zw.Close()
+}
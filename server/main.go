@@ -6,24 +6,123 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"strings"
 )
 
 func main() {
-	var dir, port string
+	var dir, tarPath, port string
 	flag.StringVar(&dir, "d", "", "The directory containing files to serve")
+	flag.StringVar(&tarPath, "tar", "", "Serve the ranges from this (uncompressed) tar, as written by hibp -o, rather than from -d")
 	flag.StringVar(&port, "p", "8009", "The port on which to serve (localhost)")
+	var noGzip bool
+	flag.BoolVar(&noGzip, "no-gzip", false, "Never compress the ranges, even if the client accepts gzip")
+	var logFormat, logLevel string
+	flag.StringVar(&logFormat, "log-format", "text", "The format of the logs: text or json")
+	flag.StringVar(&logLevel, "log-level", "info", "The minimum level to log: debug, info, warn, or error")
 	flag.Parse()
-	_, err := os.Stat(dir)
-	assert(err == nil, "the directory %q must exist: %v", dir, err)
+	slog.SetDefault(slog.New(newLogHandler(logFormat, logLevel)))
 
-	slog.Info("Serving", slog.String("port", port), slog.String("dir", dir))
-	http.Handle("/", http.FileServer(http.Dir(dir)))
-	err = http.ListenAndServe(":"+port, nil)
+	// Both serve a range with its headers set (see setRangeHeaders); they differ
+	// in where the ranges come from and in what they serve otherwise.
+	var fs http.Handler
+	var serveRange func(w http.ResponseWriter, r *http.Request, gzipped bool)
+	if tarPath != "" {
+		assert(dir == "", "-d can't be combined with -tar")
+		t, err := openTarRanges(tarPath)
+		assert(err == nil, "indexing %q: %v", tarPath, err)
+		slog.Info("Indexed the tar", slog.String("tar", tarPath), slog.String("mode", t.mode), slog.Int("ranges", len(t.index)))
+		fs = http.NotFoundHandler()
+		serveRange = t.serve
+	} else {
+		_, err := os.Stat(dir)
+		assert(err == nil, "the directory %q must exist: %v", dir, err)
+		root := http.Dir(dir)
+		fs = http.FileServer(root)
+		serveRange = func(w http.ResponseWriter, r *http.Request, gzipped bool) {
+			setRangeHeaders(w, root, r.URL.Path, gzipped)
+			fs.ServeHTTP(w, r)
+		}
+	}
+
+	slog.Info("Serving", slog.String("port", port), slog.String("dir", dir), slog.String("tar", tarPath), slog.Bool("gzip", !noGzip))
+	// The generator's files are named in lowercase, but clients (like the real
+	// API's) may ask for uppercase prefixes.
+	http.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = strings.ToLower(r.URL.Path)
+		if !strings.HasPrefix(r.URL.Path, "/range/") {
+			fs.ServeHTTP(w, r)
+			return
+		}
+		// As in the real API, the NTLM ranges are asked for with ?mode=ntlm; the
+		// generator writes them to a directory of their own.
+		if r.URL.Query().Get("mode") == "ntlm" {
+			r.URL.Path = "/range-ntlm/" + strings.TrimPrefix(r.URL.Path, "/range/")
+		}
+
+		// A range is always compressed whole, so a byte-range request for it is
+		// served the whole range.
+		compress := !noGzip && acceptsGzip(r)
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !compress {
+			serveRange(w, r, false)
+			return
+		}
+		r.Header.Del("Range")
+		gw := &gzipWriter{ResponseWriter: w}
+		serveRange(gw, r, true)
+		if r.Method == http.MethodHead {
+			return // There's no body to finish.
+		}
+		if err := gw.close(); err != nil {
+			slog.Warn("Failed to compress a range", slog.String("path", r.URL.Path), slog.String("error", err.Error()))
+		}
+	}))
+	err := http.ListenAndServe(":"+port, nil)
 	assert(err == nil, "the server produced an error: %v", err)
 }
 
+// setRangeHeaders sets the headers of a range as the real API does, with a
+// plain-text body and an ETag. The ETag is derived from the file's modification
+// time and size (and whether it's gzipped, as that's a different
+// representation); the file server compares it with any If-None-Match and
+// responds with a 304 if it matches.
+func setRangeHeaders(w http.ResponseWriter, root http.Dir, name string, gzipped bool) {
+	f, err := root.Open(name)
+	if err != nil {
+		return // The file server responds with the error.
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	etag := fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size())
+	if gzipped {
+		etag += "-gzip"
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+}
+
 func assert(b bool, msg string, args ...any) {
 	if !b {
 		panic("assertion failed: " + fmt.Sprintf(msg, args...))
 	}
 }
+
+// newLogHandler returns a handler writing to stderr in the given format (text
+// or json) that drops records below the given level (e.g., warn).
+func newLogHandler(format, level string) slog.Handler {
+	var l slog.Level
+	assert(l.UnmarshalText([]byte(level)) == nil, "the log level must be debug, info, warn, or error, not %q", level)
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		return slog.NewJSONHandler(os.Stderr, opts)
+	}
+	assert(false, "the log format must be text or json, not %q", format)
+	return nil
+}
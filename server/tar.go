@@ -0,0 +1,92 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// tarRanges serves the ranges from a tar, as written by hibp -o. The tar is
+// indexed once, so that each request reads only its own member. The tar holds
+// the ranges of a single mode, read from the file hibp writes alongside it (or
+// sha1 if there isn't one), and requests for the other mode aren't found.
+type tarRanges struct {
+	f       *os.File
+	modTime time.Time
+	mode    string
+	index   map[string][2]int64 // The offset and size of each member, by name.
+}
+
+func openTarRanges(path string) (*tarRanges, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	mode := "sha1"
+	bs, err := os.ReadFile(path + ".mode")
+	if err == nil {
+		mode = strings.TrimSpace(string(bs))
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		f.Close()
+		return nil, err
+	}
+
+	t := &tarRanges{f: f, modTime: fi.ModTime(), mode: mode, index: make(map[string][2]int64)}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		// A tar from an interrupted run has no trailer, but the members before
+		// that are still usable.
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return t, nil
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		// tar.Reader reads f directly, so f is now positioned at the member's
+		// data.
+		off, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		t.index[hdr.Name] = [2]int64{off, hdr.Size}
+	}
+}
+
+// serve serves the range named by the request's (lowercased) path.
+func (t *tarRanges) serve(w http.ResponseWriter, r *http.Request, gzipped bool) {
+	mode := "sha1"
+	if path.Dir(r.URL.Path) == "/range-ntlm" {
+		mode = "ntlm"
+	}
+	span, ok := t.index[path.Base(r.URL.Path)]
+	if !ok || mode != t.mode {
+		http.NotFound(w, r)
+		return
+	}
+
+	// As in setRangeHeaders, but the member's offset and size stand in for the
+	// file's.
+	etag := fmt.Sprintf("%x-%x-%x", t.modTime.UnixNano(), span[0], span[1])
+	if gzipped {
+		etag += "-gzip"
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("ETag", `"`+etag+`"`)
+	http.ServeContent(w, r, "", t.modTime, io.NewSectionReader(t.f, span[0], span[1]))
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// checkpoint is the progress of a run: the last two-character prefix that was
+// completed and the size of the output once it had been written. The offset
+// lets a resumed run discard anything written for a chunk that didn't complete.
+type checkpoint struct {
+	prefix int
+	offset int64
+}
+
+// loadState reads the checkpoint at path. It returns false if there isn't one.
+func loadState(path string) (checkpoint, bool, error) {
+	bs, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return checkpoint{}, false, nil
+	}
+	if err != nil {
+		return checkpoint{}, false, err
+	}
+
+	var c checkpoint
+	if _, err := fmt.Sscanf(string(bs), "%02x %d\n", &c.prefix, &c.offset); err != nil {
+		return checkpoint{}, false, fmt.Errorf("the state file %q is corrupt: %w", path, err)
+	}
+	if c.prefix < 0 || c.prefix > 0xff || c.offset < 0 {
+		return checkpoint{}, false, fmt.Errorf("the state file %q is out of range (prefix: %x, offset: %d)", path, c.prefix, c.offset)
+	}
+	return c, true, nil
+}
+
+// saveState atomically replaces the checkpoint at path.
+func saveState(path string, c checkpoint) error {
+	f, err := createAtomic(path)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%02x %d\n", c.prefix, c.offset); err != nil {
+		f.abort()
+		return err
+	}
+	return f.commit()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stats holds counters updated by the workers.
+type stats struct {
+	bytes     atomic.Int64 // Of the ranges, once decompressed.
+	wire      atomic.Int64 // Read from the connections; see countReads.
+	requests  atomic.Int64
+	active    atomic.Int64
+	ranges    atomic.Int64 // The ranges fetched successfully.
+	entries   atomic.Int64 // The lines of those ranges.
+	retries   atomic.Int64
+	throttled atomic.Int64
+	prefix    atomic.Int64 // The latest chunk to be started.
+
+	peakActive atomic.Int64
+	latency    *latencyHistogram // Optional; see -report.
+}
+
+// start records that a worker has started on a range.
+func (s *stats) start() {
+	n := s.active.Add(1)
+	for {
+		peak := s.peakActive.Load()
+		if n <= peak || s.peakActive.CompareAndSwap(peak, n) {
+			return
+		}
+	}
+}
+
+// logStats logs the throughput every interval until the returned function is
+// called. The function waits for the logging goroutine to exit.
+func (s *stats) logStats(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last := time.Now()
+		lastBytes, lastRequests := s.bytes.Load(), s.requests.Load()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				bytes, requests := s.bytes.Load(), s.requests.Load()
+				secs := now.Sub(last).Seconds()
+				slog.Info("Throughput",
+					slog.Float64("bytes_per_sec", float64(bytes-lastBytes)/secs),
+					slog.Float64("requests_per_sec", float64(requests-lastRequests)/secs),
+					slog.Int64("active_workers", s.active.Load()))
+				last, lastBytes, lastRequests = now, bytes, requests
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
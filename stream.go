@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// getChunkStream is the alternative to getChunk used under -stream. Each range
+// is written to a temporary file as soon as it arrives, and the tar is then
+// built by reading the files back in order. A response's body is copied straight
+// to its file, so no range is held in memory, however large it is.
+func (d *hibp) getChunkStream(ctx context.Context, two int) error {
+	dir, err := os.MkdirTemp("", fmt.Sprintf("hibp-%02x-*", two))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(d.workers)
+	for j := 0x000; j <= 0xfff && ctx.Err() == nil; j++ {
+		three := j
+		eg.Go(func() error {
+			five := two*0x1000 + three
+			f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%05x", five)), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+			if err != nil {
+				return err
+			}
+			if err := d.getOne(ctx, five, &spool{f: f}); err != nil {
+				f.Close()
+				return &rangeError{five: five, err: err}
+			}
+			return f.Close()
+		})
+	}
+
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	if err := d.tarFiles(two, dir); err != nil {
+		return fmt.Errorf("writing the tar: %w", err)
+	}
+	return nil
+}
+
+// spool is a range's file under -stream.
+type spool struct {
+	f   *os.File
+	err error // From Reset, which can't return it.
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	return s.f.Write(p)
+}
+
+// Reset empties the file.
+func (s *spool) Reset() {
+	if s.err = s.f.Truncate(0); s.err == nil {
+		_, s.err = s.f.Seek(0, io.SeekStart)
+	}
+}
+
+// tarFiles writes the chunk's ranges from the files in dir to the output.
+func (d *hibp) tarFiles(two int, dir string) error {
+	tw := tar.NewWriter(d.sink())
+	for three := 0x000; three <= 0xfff; three++ {
+		five := two*0x1000 + three
+		f, err := os.Open(filepath.Join(dir, fmt.Sprintf("%05x", five)))
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err == nil {
+			err = writeMember(tw, d.hdr, d.manifest, five, fi.Size(), f)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	// As in tar, the trailer is left for the end of the run.
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if d.out != nil {
+		return d.out.flush(two)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// tarDir writes each chunk as a tar of its own (with its trailer), named by its
+// two-character prefix (e.g., 0a.tar). Each tar is written to a temporary file
+// and renamed into place once it's complete, so a tar in the directory is never
+// partial, however the run ends. Under -gzip, each tar is compressed as it's
+// written (e.g., to 0a.tar.gz).
+type tarDir struct {
+	dir   string
+	hdr   tar.Header // The template for each member.
+	level int        // The gzip level, if nonzero.
+}
+
+func newTarDir(dir string, hdr tar.Header, level int) (*tarDir, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &tarDir{dir: dir, hdr: hdr, level: level}, nil
+}
+
+// name returns the path of the tar of a two-character prefix.
+func (t *tarDir) name(two int) string {
+	name := fmt.Sprintf("%02x.tar", two)
+	if t.level != 0 {
+		name += ".gz"
+	}
+	return filepath.Join(t.dir, name)
+}
+
+// todo returns the chunks whose tars aren't yet in the directory. As a tar is
+// only renamed into place once it's complete, those that are can be skipped.
+func (t *tarDir) todo(chunks []int) ([]int, error) {
+	var left []int
+	for _, two := range chunks {
+		_, err := os.Stat(t.name(two))
+		if errors.Is(err, fs.ErrNotExist) {
+			left = append(left, two)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+// write writes the tar of a two-character prefix.
+func (t *tarDir) write(two int, bufs []*bytes.Buffer) error {
+	f, err := createAtomic(t.name(two))
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(f)
+	var w io.Writer = bw
+	var zw *gzip.Writer
+	if t.level != 0 {
+		if zw, err = gzip.NewWriterLevel(bw, t.level); err != nil {
+			f.abort()
+			return err
+		}
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	for three, buf := range bufs {
+		if err := writeMember(tw, t.hdr, nil, two*0x1000+three, int64(buf.Len()), bytes.NewReader(buf.Bytes())); err != nil {
+			f.abort()
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		f.abort()
+		return err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			f.abort()
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		f.abort()
+		return err
+	}
+	return f.commit()
+}
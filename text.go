@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// text writes every entry as a full hash (the five-character prefix joined to
+// the suffix) followed by its count, one per line, in ascending order. The
+// output is deterministic so that successive snapshots of a curated subset of
+// prefixes produce minimal diffs under version control.
+//
+// The hash and count are separated by fieldSep and each line is terminated by
+// lineSep; these default to the API's ":" and "\n".
+type text struct {
+	path     string
+	f        *os.File // Opened by prepare.
+	w        *bufio.Writer
+	lines    [][]byte
+	fieldSep []byte
+	lineSep  []byte
+}
+
+func newText(path, fieldSep, lineSep string) (*text, error) {
+	if err := checkSeparator(fieldSep); err != nil {
+		return nil, fmt.Errorf("the field separator %q: %w", fieldSep, err)
+	}
+	if err := checkSeparator(lineSep); err != nil {
+		return nil, fmt.Errorf("the line separator %q: %w", lineSep, err)
+	}
+	return &text{path: path, fieldSep: []byte(fieldSep), lineSep: []byte(lineSep)}, nil
+}
+
+// prepare opens the file for a run starting from the given chunk. A new run
+// truncates it; a resumed run keeps the lines of the chunks before start, as
+// the tar does, and appends to them.
+func (t *text) prepare(resume bool, start int) error {
+	var end int64
+	if resume {
+		var err error
+		if end, err = t.kept(start); err != nil {
+			return err
+		}
+	}
+	f, err := openTruncated(t.path, end)
+	if err != nil {
+		return err
+	}
+	t.f, t.w = f, bufio.NewWriter(f)
+	return nil
+}
+
+// kept returns the size of the lines before the given chunk. The lines are in
+// ascending order, so they're read up to the first of a chunk that's to be
+// fetched again (or a line left unfinished by the run being resumed).
+func (t *text) kept(start int) (int64, error) {
+	f, err := os.Open(t.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, fmt.Errorf("%q is missing, so it can't be resumed (see -restart)", t.path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var end int64
+	sc := bufio.NewScanner(f)
+	sc.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.Index(data, t.lineSep); i >= 0 {
+			return i + len(t.lineSep), data[:i], nil
+		}
+		if atEOF {
+			return len(data), nil, nil // An unfinished line is dropped.
+		}
+		return 0, nil, nil
+	})
+	for sc.Scan() {
+		line := sc.Bytes()
+		two, err := strconv.ParseUint(string(line[:min(len(line), 2)]), 16, 8)
+		if err != nil {
+			return 0, fmt.Errorf("%q has a malformed line: %q", t.path, line)
+		}
+		if int(two) >= start {
+			break
+		}
+		end += int64(len(line) + len(t.lineSep))
+	}
+	return end, sc.Err()
+}
+
+// checkSeparator rejects separators that could be confused with the hashes or
+// the counts.
+func checkSeparator(sep string) error {
+	if sep == "" {
+		return errors.New("it is empty")
+	}
+	if i := strings.IndexAny(sep, "0123456789abcdefABCDEF"); i >= 0 {
+		return fmt.Errorf("it contains the hexadecimal character %q", sep[i])
+	}
+	return nil
+}
+
+// write appends the entries of a two-character prefix. The ranges are visited
+// in ascending order and the entries of each range are sorted, so the output is
+// globally sorted without relying on the server's ordering. The lines are
+// flushed to the file, so that a run resumed after this chunk can keep them.
+func (t *text) write(two int, bufs []*bytes.Buffer) error {
+	for three, buf := range bufs {
+		t.lines = t.lines[:0]
+		for _, line := range bytes.Split(buf.Bytes(), []byte("\n")) {
+			line = bytes.TrimSpace(line) // Also drops the \r of a CRLF.
+			if len(line) > 0 {
+				t.lines = append(t.lines, line)
+			}
+		}
+		slices.SortFunc(t.lines, bytes.Compare)
+
+		prefix := fmt.Sprintf("%05X", two*0x1000+three)
+		for _, line := range t.lines {
+			t.w.WriteString(prefix)
+			if hash, count, ok := bytes.Cut(line, []byte(":")); ok {
+				t.w.Write(hash)
+				t.w.Write(t.fieldSep)
+				t.w.Write(count)
+			} else {
+				t.w.Write(line)
+			}
+			if _, err := t.w.Write(t.lineSep); err != nil {
+				return err
+			}
+		}
+	}
+	return t.w.Flush()
+}
+
+func (t *text) close() error {
+	if t.f == nil {
+		return nil
+	}
+	if err := t.w.Flush(); err != nil {
+		return err
+	}
+	return t.f.Close()
+}
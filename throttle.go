@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// throttleWindow is the period over which the latencies are averaged by a
+// latencyThrottle.
+const throttleWindow = 5 * time.Second
+
+// latencyThrottle slows the requests down when the server slows down, under
+// -throttle-latency. When the mean latency over a window rises above the
+// threshold, the limiter's rate is halved from the rate achieved in the window;
+// once the mean falls below half the threshold, the rate is doubled, until it's
+// back where it was (the -rps, or no limit at all). This is gentler on a
+// struggling server than a fixed rate, and it recovers by itself.
+type latencyThrottle struct {
+	l         *limiter
+	threshold time.Duration
+	ceiling   float64 // The -rps, if it's set.
+
+	mu    sync.Mutex
+	began time.Time // The start of the window.
+	sum   time.Duration
+	n     int
+	rate  float64 // The limiter's rate while throttling, or zero.
+	top   float64 // The rate to be restored, once it's been reached again.
+}
+
+func newLatencyThrottle(l *limiter, threshold time.Duration, ceiling float64) *latencyThrottle {
+	return &latencyThrottle{l: l, threshold: threshold, ceiling: ceiling}
+}
+
+// observe records how long a request took.
+func (t *latencyThrottle) observe(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.observeAt(d, time.Now())
+}
+
+func (t *latencyThrottle) observeAt(d time.Duration, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.n == 0 {
+		t.began = now
+	}
+	t.sum += d
+	t.n++
+	elapsed := now.Sub(t.began)
+	if elapsed < throttleWindow {
+		return
+	}
+
+	mean := t.sum / time.Duration(t.n)
+	achieved := float64(t.n) / elapsed.Seconds()
+	t.sum, t.n = 0, 0
+	switch {
+	case mean > t.threshold:
+		if t.rate == 0 {
+			t.rate, t.top = achieved, t.ceiling
+			if t.top == 0 {
+				t.top = achieved
+			}
+		}
+		// The rate is never throttled to less than a request a second.
+		t.rate = max(1, min(t.rate, achieved)/2)
+		t.l.setRate(t.rate)
+		slog.Warn("Slowing down for a slow server", slog.Duration("mean_latency", mean), slog.Duration("threshold", t.threshold),
+			slog.Float64("rps", t.rate))
+	case mean < t.threshold/2 && t.rate > 0:
+		t.rate *= 2
+		if t.rate < t.top {
+			t.l.setRate(t.rate)
+			slog.Info("Speeding up for a recovered server", slog.Duration("mean_latency", mean), slog.Float64("rps", t.rate))
+			return
+		}
+		t.rate = 0
+		t.l.setRate(t.ceiling)
+		slog.Info("Restored the request rate", slog.Duration("mean_latency", mean), slog.Float64("rps", t.ceiling))
+	}
+}
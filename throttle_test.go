@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyThrottle(t *testing.T) {
+	l := newLimiter(0)
+	th := newLatencyThrottle(l, 100*time.Millisecond, 0)
+	now := time.Unix(0, 0)
+	// window feeds 100 requests over a throttleWindow, each taking d.
+	window := func(d time.Duration) {
+		for i := 0; i <= 100; i++ {
+			th.observeAt(d, now)
+			now = now.Add(throttleWindow / 100)
+		}
+	}
+
+	window(10 * time.Millisecond)
+	if l.per != 0 {
+		t.Fatalf("throttled a fast server to %v per request", time.Duration(l.per))
+	}
+	// The 101 requests in a window make for a rate of 20.2 a second.
+	achieved := 101 / throttleWindow.Seconds()
+	window(time.Second)
+	if got, want := th.rate, achieved/2; got != want {
+		t.Fatalf("got a throttled rate of %v, want %v", got, want)
+	}
+	window(time.Second)
+	if got, want := th.rate, achieved/4; got != want {
+		t.Fatalf("got a rate of %v after another slow window, want %v", got, want)
+	}
+	window(10 * time.Millisecond)
+	if got, want := th.rate, achieved/2; got != want {
+		t.Fatalf("got a rate of %v after a fast window, want %v", got, want)
+	}
+	window(10 * time.Millisecond)
+	if th.rate != 0 || l.per != 0 {
+		t.Fatalf("didn't restore the unlimited rate (rate %v, per %v)", th.rate, l.per)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// maxLineLen bounds a well-formed line: the suffix, a colon, a count of at most
+// 20 digits, and "\r".
+const maxLineLen = 40 + 1 + 20 + 1
+
+// lineChecker passes a range's body through to w, counting its lines (the last
+// of which may not end with a newline). If hashLen is set (under -validate), it
+// also checks that every line has the form SUFFIX:COUNT, where SUFFIX is
+// hashLen uppercase hexadecimal characters and COUNT is a positive integer.
+// Lines may end in "\n" or "\r\n". This runs over every range, so it works on
+// the bytes in place; only a line split across writes is copied.
+type lineChecker struct {
+	w       io.Writer
+	hashLen int
+	lines   int64
+	partial []byte // The start of a line split across writes.
+	open    bool   // Within a line (which, without hashLen, isn't kept).
+}
+
+func (c *lineChecker) Write(p []byte) (int, error) {
+	if c.hashLen != 0 {
+		if err := c.check(p); err != nil {
+			return 0, err
+		}
+	} else {
+		c.lines += int64(bytes.Count(p, []byte{'\n'}))
+	}
+	if len(p) > 0 {
+		c.open = p[len(p)-1] != '\n'
+	}
+	return c.w.Write(p)
+}
+
+func (c *lineChecker) check(p []byte) error {
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			c.partial = append(c.partial, p...)
+			if len(c.partial) > maxLineLen {
+				return c.malformed(c.partial)
+			}
+			return nil
+		}
+		line := p[:i]
+		if len(c.partial) > 0 {
+			c.partial = append(c.partial, line...)
+			line = c.partial
+		}
+		if err := c.checkLine(line); err != nil {
+			return err
+		}
+		c.lines++
+		c.partial, p = c.partial[:0], p[i+1:]
+	}
+	return nil
+}
+
+func (c *lineChecker) checkLine(line []byte) error {
+	if !validLine(bytes.TrimSuffix(line, []byte("\r")), c.hashLen) {
+		return c.malformed(line)
+	}
+	return nil
+}
+
+// malformed reports a malformed line. The line is truncated as it may be
+// anything (e.g., an HTML page).
+func (c *lineChecker) malformed(line []byte) error {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if len(line) > 80 {
+		line = line[:80]
+	}
+	return fmt.Errorf("malformed line %d in the response: %q", c.lines+1, line)
+}
+
+// close checks and counts the last line if it doesn't end with a newline.
+func (c *lineChecker) close() error {
+	if !c.open {
+		return nil
+	}
+	if c.hashLen != 0 {
+		if err := c.checkLine(c.partial); err != nil {
+			return err
+		}
+	}
+	c.lines++
+	c.open = false
+	return nil
+}
+
+// validLine reports whether line is a well-formed SUFFIX:COUNT entry.
+func validLine(line []byte, hashLen int) bool {
+	if len(line) < hashLen+2 || line[hashLen] != ':' {
+		return false
+	}
+	for _, c := range line[:hashLen] {
+		if !('0' <= c && c <= '9' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	count := line[hashLen+1:]
+	if count[0] == '0' {
+		return false // Zero, or a leading zero.
+	}
+	for _, c := range count {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
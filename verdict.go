@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// verdict is what -verdict prints for a password, for a password-strength
+// checker to act on.
+type verdict struct {
+	Pwned    bool   `json:"pwned"`
+	Count    int    `json:"count"`
+	Severity string `json:"severity"`
+}
+
+// severities are the buckets of a verdict, by the least count in each.
+var severities = []struct {
+	min  int
+	name string
+}{
+	{100_000, "critical"},
+	{1000, "high"},
+	{10, "medium"},
+	{1, "low"},
+	{0, "none"},
+}
+
+func newVerdict(count int) verdict {
+	v := verdict{Pwned: count > 0, Count: count}
+	for _, s := range severities {
+		if count >= s.min {
+			v.Severity = s.name
+			break
+		}
+	}
+	return v
+}
+
+// write writes v as a line of JSON.
+func (v verdict) write(w io.Writer) error {
+	return json.NewEncoder(w).Encode(v)
+}
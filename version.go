@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version and buildDate are set at build time with, e.g.,
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.buildDate=$(date -u +%FT%TZ)" .
+var (
+	version   = "dev"
+	buildDate = "unknown"
+)
+
+// buildInfo describes the binary: the version, the VCS commit (as recorded by
+// the go command when building from a checkout), the build date, and the Go
+// version.
+func buildInfo() string {
+	commit, dirty := "unknown", false
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				commit = s.Value
+			case "vcs.modified":
+				dirty = s.Value == "true"
+			}
+		}
+	}
+	if dirty {
+		commit += "-dirty"
+	}
+	return fmt.Sprintf("hibp %s (commit: %s, built: %s, %s)", version, commit, buildDate, runtime.Version())
+}
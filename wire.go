@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+)
+
+// countReads wraps dial so that every byte read from its connections is added
+// to n. That's what crosses the wire: the headers and, as the transport asks for
+// gzip, the compressed bodies (and the TLS records around them, if any).
+func countReads(dial func(ctx context.Context, network, addr string) (net.Conn, error), n *atomic.Int64) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &countingConn{Conn: c, n: n}, nil
+	}
+}
+
+type countingConn struct {
+	net.Conn
+	n *atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}